@@ -0,0 +1,102 @@
+package skunk
+
+import (
+	"context"
+	"sort"
+)
+
+// PluginAccount is a NewRelic account that an agent sends the metrics of some of its components to, in addition to
+// the account of the license key it was created with. Components are routed to accounts with Component.SetAccount.
+type PluginAccount struct {
+	// LicenseKey is the license key of the account. If empty, the agent's license key is used.
+	LicenseKey string
+	// URL is the plugin API endpoint the account's metrics are sent to, such as one in another region. If empty, the
+	// agent's endpoint (NewRelicAPI as of the agent's creation) is used.
+	URL string
+}
+
+// SetAccount routes the component's metrics to the named account in the agent's Accounts, instead of the account of
+// the agent's license key. If name is empty, the component is routed back to the agent's license key. It returns
+// ErrUnknownAccount if the agent has no such account. Metrics recorded before the component's account is changed but
+// not yet sent may be sent to either account.
+func (c *Component) SetAccount(name string) error {
+	if _, ok := c.agent.Accounts[name]; name != "" && !ok {
+		return mkerr(ErrUnknownAccount, nil)
+	}
+
+	c.agent.ops <- func(*Agent) error {
+		c.account = name
+		return nil
+	}
+	return nil
+}
+
+// pluginExporter sends metrics to NewRelic's plugin API on behalf of an agent. It sends the components routed to any
+// of accounts, all of which share its URL and license key, so that each license key is sent a single payload per
+// cycle.
+type pluginExporter struct {
+	agent    *Agent
+	url, key string
+	accounts map[string]bool
+}
+
+func (p pluginExporter) Export(ctx context.Context, body *Body) error {
+	return p.agent.sendRequest(ctx, body, p.url, p.key)
+}
+
+// route returns the part of body holding the components routed to the exporter's accounts, or nil if there are none.
+func (p pluginExporter) route(body *Body) *Body {
+	routed := &Body{Agent: body.Agent}
+	for _, com := range body.Components {
+		if p.accounts[com.account] {
+			routed.Components = append(routed.Components, com)
+		}
+	}
+	if len(routed.Components) == 0 {
+		return nil
+	}
+	return routed
+}
+
+// pluginExporters returns an exporter, and the name of its destination, for each distinct endpoint and license key
+// among the agent's license key and Accounts. The agent's own is first.
+func (a *Agent) pluginExporters() (names []string, exporters []pluginExporter) {
+	index := make(map[string]int)
+	add := func(name, url, key string) {
+		if i, ok := index[url+"\x00"+key]; ok {
+			exporters[i].accounts[name] = true
+			return
+		}
+
+		index[url+"\x00"+key] = len(exporters)
+		exporters = append(exporters, pluginExporter{agent: a, url: url, key: key, accounts: map[string]bool{name: true}})
+		if name == "" {
+			names = append(names, "NewRelic")
+		} else {
+			names = append(names, "NewRelic ("+name+")")
+		}
+	}
+
+	add("", a.apiURL, a.apiKey)
+
+	accounts := make([]string, 0, len(a.Accounts))
+	for name := range a.Accounts {
+		if name != "" {
+			accounts = append(accounts, name)
+		}
+	}
+	sort.Strings(accounts)
+
+	for _, name := range accounts {
+		acct := a.Accounts[name]
+		url, key := acct.URL, acct.LicenseKey
+		if url == "" {
+			url = a.apiURL
+		}
+		if key == "" {
+			key = a.apiKey
+		}
+		add(name, url, key)
+	}
+	return names, exporters
+}
@@ -0,0 +1,131 @@
+package skunk
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// accountAgent returns an agent with accounts on its own endpoint and license key, another license key, and another
+// endpoint.
+func accountAgent(t *testing.T) *Agent {
+	a := newTestAgent(t)
+	a.apiURL = "https://plugin.example.com"
+	a.Accounts = map[string]PluginAccount{
+		"":       {LicenseKey: "ignored"},
+		"shared": {},
+		"team":   {LicenseKey: "team-key"},
+		"eu":     {URL: "https://plugin.eu.example.com"},
+		"eu2":    {URL: "https://plugin.eu.example.com"},
+	}
+	return a
+}
+
+// exporterAccounts returns the sorted accounts an exporter sends.
+func exporterAccounts(p pluginExporter) []string {
+	var accounts []string
+	for name := range p.accounts {
+		accounts = append(accounts, name)
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+func TestPluginExporters(t *testing.T) {
+	names, exporters := accountAgent(t).pluginExporters()
+
+	want := []struct {
+		name, url, key string
+		accounts       []string
+	}{
+		// Accounts sharing the agent's endpoint and license key are sent with the agent's own.
+		{"NewRelic", "https://plugin.example.com", "key", []string{"", "shared"}},
+		{"NewRelic (eu)", "https://plugin.eu.example.com", "key", []string{"eu", "eu2"}},
+		{"NewRelic (team)", "https://plugin.example.com", "team-key", []string{"team"}},
+	}
+	if len(exporters) != len(want) || len(names) != len(want) {
+		t.Fatalf("got %d exporters named %q; want %d", len(exporters), names, len(want))
+	}
+	for i, w := range want {
+		p := exporters[i]
+		if names[i] != w.name || p.url != w.url || p.key != w.key {
+			t.Errorf("exporter %d = %s %s %s; want %s %s %s", i, names[i], p.url, p.key, w.name, w.url, w.key)
+		}
+		if got := exporterAccounts(p); !reflect.DeepEqual(got, w.accounts) {
+			t.Errorf("exporter %s accounts = %q; want %q", names[i], got, w.accounts)
+		}
+	}
+}
+
+func TestPluginExporterRoute(t *testing.T) {
+	_, exporters := accountAgent(t).pluginExporters()
+
+	body := &Body{Agent: AgentRep{Host: "host"}, Components: []*Component{
+		{Name: "default"},
+		{Name: "shared", account: "shared"},
+		{Name: "eu", account: "eu"},
+		{Name: "eu2", account: "eu2"},
+		{Name: "team", account: "team"},
+	}}
+	want := [][]string{
+		{"default", "shared"},
+		{"eu", "eu2"},
+		{"team"},
+	}
+	for i, p := range exporters {
+		routed := p.route(body)
+		var got []string
+		for _, com := range routed.Components {
+			got = append(got, com.Name)
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("exporter %d routed %q; want %q", i, got, want[i])
+		}
+		if routed.Agent != body.Agent {
+			t.Errorf("exporter %d routed agent %+v; want %+v", i, routed.Agent, body.Agent)
+		}
+	}
+
+	// Nothing is sent to an exporter with no components routed to it.
+	if routed := exporters[2].route(&Body{Components: []*Component{{Name: "default"}}}); routed != nil {
+		t.Errorf("route() = %+v; want nil", routed)
+	}
+}
+
+func TestPrimaryDestination(t *testing.T) {
+	tests := []struct {
+		name        string
+		disable     bool
+		wantPrimary []string
+	}{
+		// Only the agent's own account is primary, so another account's rejections don't become the agent's Err.
+		{"plugin API", false, []string{"NewRelic"}},
+		{"plugin API disabled", true, []string{"*skunk.recordingExporter"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := accountAgent(t)
+			if !tt.disable {
+				names, exporters := a.pluginExporters()
+				for i, exp := range exporters {
+					a.addDestination(names[i], exp, 0)
+				}
+			}
+			a.addDestination("*skunk.recordingExporter", newRecordingExporter(), 0)
+			a.addDestination("*skunk.recordingExporter (second)", newRecordingExporter(), 0)
+
+			var primary []string
+			for _, d := range a.destinations {
+				if d.primary {
+					primary = append(primary, d.name)
+				}
+				d.close()
+				<-d.done
+			}
+			if !reflect.DeepEqual(primary, tt.wantPrimary) {
+				t.Errorf("primary destinations = %q; want %q", primary, tt.wantPrimary)
+			}
+		})
+	}
+}
@@ -2,15 +2,15 @@ package skunk
 
 import (
 	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
-	"sort"
-	"text/tabwriter"
+	"sync"
 	"time"
 )
 
@@ -31,20 +31,107 @@ type opFunc func(*Agent) error
 type Agent struct {
 	// Initialization fields -- these may not change after Start is called. Prior to calling Start, you may tweak
 	// them to your heart's content.
-	Cycle      time.Duration
-	Client     *http.Client
+	Cycle  time.Duration
+	Client *http.Client
+	// Logger receives the agent's log messages. If nil, Start creates a Logger that writes text to Log.
+	Logger *slog.Logger
+	// Log receives the metrics written each cycle when LogMetrics is set and, if Logger is nil, the agent's log
+	// messages.
 	Log        io.Writer
 	LogMetrics bool
-
-	apiURL string
-	apiKey string
+	// MetricFormat is the format metrics are written to Log in when LogMetrics is set. If nil, TableFormat is used.
+	MetricFormat MetricFormatter
+	// MaxCollectors is the maximum number of Collectors run concurrently each cycle. If zero or less, all collectors
+	// are run at once.
+	MaxCollectors int
+	// NonFinite controls what happens to metrics holding NaN or ±Inf values. By default, they're dropped.
+	NonFinite NonFinitePolicy
+	// FlattenAttributes folds the attributes of metrics recorded with them into their names for NewRelic's plugin API
+	// and anything else that doesn't support dimensions. If nil, FlattenAttributeValues is used.
+	FlattenAttributes AttributeFlattener
+	// Compression is the algorithm payloads are compressed with. By default, payloads are gzipped. Use NoCompression to
+	// send them as plain JSON, such as when reading them through a debugging proxy.
+	Compression Compression
+	// CompressionLevel is the compression level payloads are compressed at, as defined by compress/flate (e.g.,
+	// flate.BestSpeed). If zero or invalid, the default level is used. To disable compression, set Compression to
+	// NoCompression.
+	CompressionLevel int
+	// CompressionThreshold is the size, in bytes, below which payloads are sent uncompressed. Small payloads gain
+	// little from compression. If zero or less, payloads are always compressed.
+	CompressionThreshold int
+	// Exporters receive the agent's metrics each cycle, in addition to NewRelic's plugin API, and are each given up to
+	// DefaultExportTimeout to accept them. Every destination -- the plugin API and each exporter -- is sent the same
+	// snapshot of the agent's metrics from its own goroutine and keeps its own backlog of metrics to retry, so one that's
+	// failing or slow doesn't hold up or lose metrics for the others. Errors are logged and kept in the agent's Status.
+	// To add exporters with other timeouts, or once the agent is running, use AddExporter.
+	Exporters []Exporter
+	// MaxBacklog is the longest span of metrics a destination holds onto while it's unavailable. Once a destination's
+	// backlog spans more than this, its older metrics are dropped and counted in its DestinationStatus. If zero or
+	// less, DefaultMaxBacklog is used.
+	MaxBacklog time.Duration
+	// DisablePluginAPI stops the agent from sending metrics to NewRelic's plugin API, for any of its accounts, leaving
+	// only its Exporters.
+	DisablePluginAPI bool
+	// Accounts are additional NewRelic accounts, by name, that components may be routed to with Component.SetAccount,
+	// such as those of other teams or regions. Components not routed to an account are sent to the account of the
+	// agent's license key. Each distinct endpoint and license key is sent a single payload per cycle, as a destination
+	// of its own (see Exporters). An account with an empty name is ignored.
+	Accounts map[string]PluginAccount
+	// EventAccountID is the NewRelic account ID that events recorded with RecordEvent are sent to. It must be set to
+	// record events.
+	EventAccountID string
+	// EventAPIKey is the key events are sent to the Event API with. If empty, the agent's license key is used.
+	EventAPIKey string
+	// MaxEvents is the maximum number of unsent events the agent holds. Once reached, the oldest events are dropped to
+	// make room for new ones. If zero or less, DefaultMaxEvents is used.
+	MaxEvents int
+
+	apiURL   string
+	apiKey   string
+	eventURL string
 
 	// Access to the following fields controlled by runloop after init
 	body     *Body
-	err      error
 	lastPoll time.Time
 	ticker   *time.Ticker
 	ops      chan<- opFunc
+	// stopped is closed once the runloop has exited.
+	stopped chan struct{}
+	// closing is closed when the agent starts shutting down, after which nothing may send on ops but the runloop.
+	closing chan struct{}
+	// runMu guards ops and closing for tryOp, which may be called at any time, against Start setting them and
+	// shutdown closing ops.
+	runMu sync.RWMutex
+
+	// Collectors run in their own goroutines, under collectCtx, which is cancelled on shutdown. collectWG tracks them,
+	// and collectSem, if non-nil, limits how many run at once (see MaxCollectors). cycle counts the agent's cycles, and
+	// collecting is the number of collectors started for the current one that haven't returned yet. The cycle's metrics
+	// are sent once it reaches zero.
+	collectCtx    context.Context
+	collectCancel context.CancelFunc
+	collectWG     sync.WaitGroup
+	collectSem    chan struct{}
+	cycle         uint64
+	collecting    int
+
+	// destinations are where the agent's metrics are sent each cycle, starting with NewRelic's plugin API unless it's
+	// disabled.
+	destinations []*destination
+
+	// Events recorded by RecordEvent that haven't been sent yet, and the number dropped for exceeding MaxEvents since
+	// the last send.
+	events        []event
+	droppedEvents int
+	// eventSender sends the events handed to it each cycle from its own goroutine.
+	eventSender *eventSender
+
+	// Bookkeeping for Status -- also controlled by the runloop
+	nextTick time.Time
+
+	// err and errHistory are also set by destinations' goroutines, so they're guarded by errMu.
+	errMu      sync.Mutex
+	err        error
+	errHistory []ErrorRecord
 }
 
 func New(version, apiKey string) (*Agent, error) {
@@ -79,8 +166,9 @@ func NewWithRep(apiKey string, rep AgentRep) (agent *Agent, err error) {
 		Log:        ioutil.Discard,
 		LogMetrics: false,
 
-		apiURL: NewRelicAPI,
-		apiKey: apiKey,
+		apiURL:   NewRelicAPI,
+		apiKey:   apiKey,
+		eventURL: EventAPI,
 
 		body: &Body{
 			Agent:      rep,
@@ -101,42 +189,102 @@ func (a *Agent) Start() {
 		a.Log = ioutil.Discard
 	}
 
+	if a.Logger == nil {
+		a.Logger = slog.New(slog.NewTextHandler(a.Log, nil))
+	}
+
 	ops := make(chan opFunc)
+	a.runMu.Lock()
 	a.ops = ops
+	a.closing = make(chan struct{})
+	a.runMu.Unlock()
+	a.stopped = make(chan struct{})
+	a.collectCtx, a.collectCancel = context.WithCancel(context.Background())
+	if a.MaxCollectors > 0 {
+		a.collectSem = make(chan struct{}, a.MaxCollectors)
+	}
+	a.eventSender = newEventSender(a)
+	go a.eventSender.run()
 
 	go a.run(ops)
 }
 
 // Close kills the agent's runloop and makes it completely inert. Using the agent afterward will result in a panic. Any
-// error held by the agent prior to shutdown is returned.
+// error held by the agent prior to shutdown is returned. Close sends any unsent metrics and waits for each of the
+// agent's destinations to make a final attempt at sending them, which may take up to its timeout.
 //
 // When calling Close, you must ensure that the agent is no longer in use and will not be used by any goroutine after
 // Close is called.
 func (a *Agent) Close() error {
 	err := a.Err()
 	a.ops <- shutdown
+	<-a.stopped
 	return err
 }
 
-// shutdown is an opFunc that closes an agent's ops channel.
+// shutdown is an opFunc that closes an agent's ops channel. It stops any running collectors, dropping their results,
+// then sends any unsent events and metrics and waits for every destination to make a final attempt at sending them.
 func shutdown(a *Agent) error {
-	if err := a.sendRequest(time.Now()); iserr(err, errMustRetry) {
-		fmt.Fprintln(a.Log, "skunk: received 50x error from NewRelic on shutdown flush - dropping payload on the floor")
-	} else if err != nil {
-		fmt.Fprintln(a.Log, "skunk: received error on sending to NewRelic:", err)
-		a.err = err
+	close(a.closing)
+	a.collectCancel()
+	a.collectWG.Wait()
+
+	a.flushEvents()
+	a.eventSender.close()
+	a.dispatch(time.Now())
+	for _, d := range a.destinations {
+		d.close()
+	}
+	for _, d := range a.destinations {
+		<-d.done
 	}
+	<-a.eventSender.done
+
+	// Anything in tryOp holding runMu has seen closing by now and is on its way out.
+	a.runMu.Lock()
 	close(a.ops)
+	a.runMu.Unlock()
 	return mkerr(errShuttingDown, nil)
 }
 
+// tryOp runs op in the runloop and returns true if the agent is running. Otherwise, it returns false without running
+// op. Unlike sending on ops, it neither blocks forever if the agent hasn't been started nor panics if it's been closed.
+func (a *Agent) tryOp(op opFunc) bool {
+	a.runMu.RLock()
+	defer a.runMu.RUnlock()
+	if a.ops == nil {
+		return false
+	}
+	// ops is only closed after closing, while runMu is held exclusively, so it's open as long as closing is.
+	select {
+	case <-a.closing:
+		return false
+	default:
+	}
+	select {
+	case a.ops <- op:
+		return true
+	case <-a.closing:
+		return false
+	}
+}
+
 type opGetErr chan<- error
 
 func (c opGetErr) Exec(a *Agent) error {
+	a.errMu.Lock()
 	c <- a.err
+	a.errMu.Unlock()
 	return nil
 }
 
+// setErr sets the error returned by Err.
+func (a *Agent) setErr(err error) {
+	a.errMu.Lock()
+	a.err = err
+	a.errMu.Unlock()
+}
+
 func (a *Agent) Err() (err error) {
 	out := make(chan error)
 	a.ops <- opGetErr(out).Exec
@@ -144,135 +292,100 @@ func (a *Agent) Err() (err error) {
 }
 
 func (a *Agent) run(ops <-chan opFunc) {
-	var timer *time.Timer
-	var retry <-chan time.Time
-	retryNeeded := false
+	defer close(a.stopped)
 
 	a.ticker = time.NewTicker(a.Cycle)
 	defer a.ticker.Stop()
+	a.nextTick = time.Now().Add(a.Cycle)
 
-	trySend := func(from time.Time) {
-		if err := a.sendRequest(from); err == nil {
-			retryNeeded = false
-			a.lastPoll = from
-			a.clear()
-		} else if iserr(err, errMustRetry) {
-			if timer == nil {
-				timer = time.NewTimer(time.Minute)
-				retry = timer.C
-			} else {
-				timer.Reset(time.Minute)
-			}
-			retryNeeded = true
-		} else {
-			a.err = err
+	if !a.DisablePluginAPI {
+		names, exporters := a.pluginExporters()
+		for i, exp := range exporters {
+			a.addDestination(names[i], exp, DefaultExportTimeout)
 		}
 	}
+	for _, exp := range a.Exporters {
+		a.addDestination(fmt.Sprintf("%T", exp), exp, DefaultExportTimeout)
+	}
 
 	for {
 		select {
-		case from := <-retry:
-			trySend(from)
 		case from := <-a.ticker.C:
-			if a.LogMetrics {
-				a.logMetrics()
+			a.nextTick = from.Add(a.Cycle)
+			if a.collecting > 0 {
+				// The last cycle's collectors have run past this one's start, so send its metrics without them.
+				a.endCycle(from)
 			}
-
-			if !retryNeeded {
-				// Let the retry loop take over until things are back to normal.
-				trySend(from)
+			if a.collect(from) == 0 {
+				a.endCycle(from)
 			}
 		case op, ok := <-ops:
 			if !ok {
 				return
 			} else if op == nil {
 				// This should be impossible. If it happens, log it and skip the op.
-				fmt.Fprintln(a.Log, ErrNilOpReceived)
+				a.Logger.Error("skunk: skipping op", "error", mkerr(ErrNilOpReceived, nil))
 				continue
 			}
 
 			if err := op(a); iserr(err, errShuttingDown) {
 				return
 			} else if err != nil {
-				a.err = err
+				a.setErr(err)
+				a.recordError(err)
 			}
 		}
 	}
 }
 
-func (a *Agent) logMetrics() {
-	if a.Log == ioutil.Discard {
-		return
+// endCycle ends the current cycle, once its collectors are done, by logging and sending the agent's metrics as of to.
+// This must only be called from the runloop.
+func (a *Agent) endCycle(to time.Time) {
+	a.collecting = 0
+	if a.LogMetrics {
+		a.logMetrics()
 	}
 
-	components := make([]Component, len(a.body.Components))
-	i := 0
-	for _, c := range a.body.Components {
-		if len(c.Metrics) > 0 {
-			components[i] = *c
-			i++
-		}
-	}
+	// Events are sent and retried independently of metrics, by the agent's event sender.
+	a.flushEvents()
+	a.dispatch(to)
+}
 
-	if i == 0 {
+// logMetrics writes the agent's current metrics to its Log using its MetricFormat. Formatting and writing happen in
+// a separate goroutine so a slow Log doesn't hold up the runloop.
+func (a *Agent) logMetrics() {
+	if a.Log == ioutil.Discard {
 		return
 	}
 
-	go logComponentMetrics(a.Log, components[:i])
-}
-
-func logComponentMetrics(w io.Writer, components []Component) {
-	if len(components) == 0 {
+	body := a.snapshot(time.Now())
+	if len(body.Components) == 0 {
 		return
 	}
 
-	var buf bytes.Buffer
-	tw := tabwriter.NewWriter(&buf, 1, 8, 1, ' ', tabwriter.TabIndent)
-
-	var keys []string
-	for _, com := range components {
-		if len(com.Metrics) == 0 {
-			continue
-		}
+	format := a.MetricFormat
+	if format == nil {
+		format = TableFormat
+	}
 
-		// Sort keys so the output is easier to sift through.
-		for key := range com.Metrics {
-			keys = append(keys, key)
+	go func() {
+		var buf bytes.Buffer
+		if err := format.FormatMetrics(&buf, body.Components); err != nil {
+			a.Logger.Warn("skunk: error formatting metrics log entries", "error", err)
+			return
 		}
-		sort.Strings(keys)
-
-		fmt.Fprintf(tw, "%s (%s) %v\n\tName\tCount\tTotal\tAverage\tMin\tMax\tSS\n", com.Name, com.GUID, com.Duration.Duration)
-		for _, key := range keys {
-			m := com.Metrics[key]
-			switch m := m.(type) {
-			case RangeMetric:
-				fmt.Fprintf(tw, "\t%s\t%v\t%v\t%v\t%v\t%v\t%v\n",
-					key, m.Count, m.Total, m.Total/float64(m.Count), m.Min, m.Max, m.Square-((m.Total*m.Total)/float64(m.Count)))
-			case ScalarMetric:
-				f := float64(m)
-				fmt.Fprintf(tw, "\t%s\t1\t%v\t%v\t%v\t%v\t0\n",
-					key, f, f, f, f)
-			default:
-				// Unknown type (at least emit something for now) -- will likely need to add accessor
-				// methods to the Metric interface later to handle these cases.
-				fmt.Fprintf(tw, "\t%s\tNA\tNA\tNA\tNA\tNA\tNA\n")
-			}
+		if _, err := buf.WriteTo(a.Log); err != nil {
+			a.Logger.Warn("skunk: error writing metrics log entries", "error", err)
 		}
-		tw.Flush()
-
-		keys = keys[0:0]
-	}
-
-	if _, err := buf.WriteTo(w); err != nil {
-		fmt.Fprintf(w, "skunk: error writing metrics log entries: %v\n", err)
-	}
+	}()
 }
 
-func (a *Agent) sendRequest(from time.Time) (err error) {
+// sendRequest sends a snapshot of the agent's metrics to NewRelic's plugin API at url using the license key.
+func (a *Agent) sendRequest(ctx context.Context, body *Body, url, key string) (err error) {
 	var buf bytes.Buffer
-	compressed := true
+	compression := a.Compression
 tryGetPayload:
-	err = a.getPayload(&buf, from, compressed)
+	compression, err = a.getPayload(&buf, body, compression)
 	switch {
 	case err == nil:
 	case iserr(err, errNoMetrics):
@@ -283,28 +396,32 @@ tryGetPayload:
 			return mkerr(ErrEncodingJSON, err)
 		}
 
-		if compressed {
+		if compression != NoCompression {
 			// Try without compression in case it's some anomalous unknown compression error that's eluded
 			// everyone but me (i.e., should be almost impossible).
-			compressed = false
+			compression = NoCompression
 			buf.Reset()
 			goto tryGetPayload
 		}
 		return err
 	}
 
-	req, err := http.NewRequest("POST", a.apiURL, &buf)
+	size := buf.Len()
+	req, err := http.NewRequest("POST", url, &buf)
 	if err != nil {
 		// No idea what happened here, assume the worst.
 		return err
 	}
 
+	// Never record metrics for the agent's own requests, in case its Client uses a Transport.
+	req = req.WithContext(WithoutMetrics(ctx))
+
 	// Set headers
-	req.Header.Set("X-License-Key", a.apiKey)
+	req.Header.Set("X-License-Key", key)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
-	if compressed {
-		req.Header.Set("Content-Encoding", "gzip")
+	if enc := compression.contentEncoding(); enc != "" {
+		req.Header.Set("Content-Encoding", enc)
 	}
 
 	resp, err := a.Client.Do(req)
@@ -312,7 +429,7 @@ tryGetPayload:
 		defer func() {
 			closeErr := resp.Body.Close()
 			if closeErr != nil {
-				fmt.Fprintf(a.Log, "skunk: error closing response body: %v\n", closeErr)
+				a.Logger.Warn("skunk: error closing response body", "error", closeErr)
 			}
 		}()
 	}
@@ -322,6 +439,7 @@ tryGetPayload:
 	}
 
 	if resp.StatusCode == 200 {
+		a.Logger.Debug("skunk: sent payload to NewRelic", "bytes", size, "compression", compression)
 		return nil
 	}
 
@@ -329,16 +447,20 @@ tryGetPayload:
 		Error string `json:"error"`
 	}
 	decoder := json.NewDecoder(resp.Body)
-	if err = decoder.Decode(nrErr); err == nil && len(nrErr.Error) > 0 {
-		fmt.Fprintf(a.Log, "skunk: received NewRelic error: %s\n", nrErr.Error)
+	if err = decoder.Decode(&nrErr); err == nil && len(nrErr.Error) > 0 {
+		a.Logger.Warn("skunk: received NewRelic error", "status", resp.StatusCode, "error", nrErr.Error)
+	} else {
+		a.Logger.Warn("skunk: received error status from NewRelic", "status", resp.StatusCode)
 	}
 	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
-		fmt.Fprintf(a.Log, "skunk: error discarding body remainder: %v\n", err)
+		a.Logger.Warn("skunk: error discarding body remainder", "error", err)
 	}
 
 	return statusError(resp)
 }
 
+// statusError returns the error for an HTTP response from any destination, or nil if its status is 2xx. Server errors,
+// timeouts, and rate limiting are errMustRetry, so the send is retried later.
 func statusError(resp *http.Response) error {
 	code := resp.StatusCode
 	switch {
@@ -354,10 +476,13 @@ func statusError(resp *http.Response) error {
 		return mkerr(ErrBadRequest, nil)
 	case code == 413:
 		return mkerr(ErrBodyTooLarge, nil)
+	case code == 408 || code == 429:
+		// Timed out or rate limited -- both are worth trying again later.
+		return mkerr(errMustRetry, nil)
 	case code >= 500 && code < 600:
 		return mkerr(errMustRetry, nil)
 	default:
-		return fmt.Errorf("skunk: got unexpected status code %d %s from NewRelic.", code, resp.Status)
+		return fmt.Errorf("skunk: unexpected response status %s", resp.Status)
 	}
 }
 
@@ -411,23 +536,65 @@ func (a *Agent) clear() {
 	for _, c := range a.body.Components {
 		// Allocate a new Metrics map and reuse the old map's length as its capacity.
 		c.Metrics = make(map[string]Metric, len(c.Metrics))
+		c.series = nil
 		c.Duration.Duration = 0 // Should be zero, but clear() says it'll make it pristine, so zero it anyway.
 		c.start = time.Time{}
 	}
 }
 
-// getPayload returns a JSON payload as a byte slice to send to NewRelic as its POSTed body. The resulting JSON does not
-// include components without metrics.
-func (a *Agent) getPayload(w io.Writer, from time.Time, compressed bool) (err error) {
-	// Make a copy of the body and exclude components without metrics.
+// Snapshot returns a copy of the agent's body as it would be sent to NewRelic right now: only components holding unsent
+// metrics are included, and their durations run up to the time of the call. The copy shares nothing with the agent, so
+// it's safe to hold onto and read from any goroutine, but its components can't be used to record metrics.
+func (a *Agent) Snapshot() *Body {
+	out := make(chan *Body)
+	a.ops <- func(a *Agent) error {
+		out <- a.snapshot(time.Now())
+		return nil
+	}
+	return <-out
+}
+
+// snapshot returns a copy of the agent's body that excludes components without metrics. Component durations are
+// calculated as of from. Metrics recorded with attributes are flattened into each component's Metrics using the
+// agent's FlattenAttributes, and kept as-is for Component.Series. Metrics are sanitized according to the agent's
+// NonFinite policy.
+func (a *Agent) snapshot(from time.Time) *Body {
 	body := *a.body
 	body.Components = make([]*Component, 0, len(body.Components))
 	for _, com := range a.body.Components {
-		if len(com.Metrics) == 0 || com.start.IsZero() {
+		if (len(com.Metrics) == 0 && len(com.series) == 0) || com.start.IsZero() {
+			continue
+		}
+
+		dupe := Component{
+			Name:       com.Name,
+			GUID:       com.GUID,
+			Metrics:    copyMetrics(com.flatMetrics(a.FlattenAttributes)),
+			Attributes: com.Attributes.clone(),
+			start:      com.start,
+			account:    com.account,
+		}
+		if sanitizeMetrics(a.NonFinite, dupe.Metrics); len(dupe.Metrics) == 0 {
 			continue
 		}
 
-		dupe := *com
+		// Keep the unflattened metrics around for exporters that support dimensions.
+		if len(com.series) == 0 {
+			dupe.plain = dupe.Metrics
+		} else {
+			dupe.plain = copyMetrics(com.Metrics)
+			dupe.series = sanitizeSeries(a.NonFinite, com.series)
+			policy := a.NonFinite
+			if policy == ReportNonFinite {
+				// Report the count of all non-finite metrics, as found in the flattened metrics, instead.
+				policy = DropNonFinite
+				if m, ok := dupe.Metrics[NonFiniteMetric]; ok {
+					dupe.plain[NonFiniteMetric] = m
+				}
+			}
+			sanitizeMetrics(policy, dupe.plain)
+		}
+
 		dupe.Duration.Duration = from.Sub(com.start)
 		if dupe.Duration.Duration < 0 {
 			// Metrics from the future aren't allowed.
@@ -436,20 +603,52 @@ func (a *Agent) getPayload(w io.Writer, from time.Time, compressed bool) (err er
 
 		body.Components = append(body.Components, &dupe)
 	}
+	return &body
+}
 
+// copyMetrics returns a shallow copy of metrics.
+func copyMetrics(metrics Metrics) Metrics {
+	dupe := make(Metrics, len(metrics))
+	for k, v := range metrics {
+		dupe[k] = v
+	}
+	return dupe
+}
+
+// getPayload writes the JSON payload to send to NewRelic as its POSTed body to buf, compressed with compression unless
+// it's smaller than the agent's CompressionThreshold, and returns the compression actually used. The payload holds the
+// metrics of body, a snapshot or snapshots merged by a destination, with each component's own duration.
+func (a *Agent) getPayload(buf *bytes.Buffer, body *Body, compression Compression) (Compression, error) {
+	// Snapshots already hold flattened and sanitized metrics, and never hold components without metrics.
 	if len(body.Components) == 0 {
-		return mkerr(errNoMetrics, nil)
+		return compression, mkerr(errNoMetrics, nil)
 	}
 
-	if compressed {
-		zipWriter := gzip.NewWriter(w)
-		defer func() {
-			if err == nil {
-				err = zipWriter.Close()
-			}
-		}()
-		w = zipWriter
+	enc := getPayloadEncoder()
+	defer putPayloadEncoder(enc)
+
+	encode := func(w io.Writer) error {
+		return enc.encode(w, body.Agent, body.Components)
+	}
+
+	switch {
+	case compression.contentEncoding() == "":
+		return NoCompression, encode(buf)
+	case a.CompressionThreshold > 0:
+		// The payload's size isn't known until it's encoded, so encode it first and compress it after if it's large
+		// enough.
+		var plain bytes.Buffer
+		if err := encode(&plain); err != nil {
+			return compression, err
+		}
+		if plain.Len() < a.CompressionThreshold {
+			_, err := plain.WriteTo(buf)
+			return NoCompression, err
+		}
+		return compression, compress(buf, compression, a.CompressionLevel, func(w io.Writer) error {
+			_, err := plain.WriteTo(w)
+			return err
+		})
 	}
-	encoder := json.NewEncoder(w)
-	return encoder.Encode(body)
+	return compression, compress(buf, compression, a.CompressionLevel, encode)
 }
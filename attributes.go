@@ -0,0 +1,189 @@
+package skunk
+
+import (
+	"sort"
+	"strings"
+)
+
+// Attributes is a set of key/value pairs describing a component or the values recorded for a metric (i.e., its
+// dimensions), such as the database and role of a query latency metric. Values recorded for the same metric name with
+// different attributes are aggregated separately.
+type Attributes map[string]string
+
+// clone returns a copy of attrs, or nil if attrs is empty.
+func (attrs Attributes) clone() Attributes {
+	if len(attrs) == 0 {
+		return nil
+	}
+	dupe := make(Attributes, len(attrs))
+	for k, v := range attrs {
+		dupe[k] = v
+	}
+	return dupe
+}
+
+// sortedKeys returns the keys of attrs in sorted order.
+func (attrs Attributes) sortedKeys() []string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Series is a metric recorded with a set of attributes. Metrics recorded without attributes have nil Attributes.
+type Series struct {
+	Name       string
+	Attributes Attributes
+	Metric     Metric
+}
+
+// seriesKey returns the key identifying the series of the given name and attributes in a component.
+func seriesKey(name string, attrs Attributes) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range attrs.sortedKeys() {
+		b.WriteByte(0)
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(attrs[k])
+	}
+	return b.String()
+}
+
+// AttributeFlattener folds the attributes of a metric into its name for NewRelic's plugin API, which only knows metrics
+// by name. Metrics flattened to the same name are merged. Component attributes aren't passed to flatteners, since the
+// component already identifies its metrics in the plugin API.
+type AttributeFlattener func(name string, attrs Attributes) string
+
+var (
+	// FlattenAttributeValues inserts the values of a metric's attributes, sorted by key, as segments of its name before
+	// its last segment. For example, Component/DB/Latency[ms] with {db: users, role: primary} is flattened to
+	// Component/DB/users/primary/Latency[ms]. This is the default.
+	FlattenAttributeValues AttributeFlattener = flattenValues
+	// FlattenAttributePairs inserts key=value segments, sorted by key, before the last segment of a metric's name. For
+	// example, Component/DB/Latency[ms] with {db: users, role: primary} is flattened to
+	// Component/DB/db=users/role=primary/Latency[ms].
+	FlattenAttributePairs AttributeFlattener = flattenPairs
+	// DropAttributes ignores a metric's attributes, merging all of its values under its name.
+	DropAttributes AttributeFlattener = func(name string, _ Attributes) string { return name }
+)
+
+func flattenValues(name string, attrs Attributes) string {
+	return flattenSegments(name, attrs, false)
+}
+
+func flattenPairs(name string, attrs Attributes) string {
+	return flattenSegments(name, attrs, true)
+}
+
+// segmentReplacer replaces slashes in attribute keys and values so they don't introduce extra segments when flattened.
+var segmentReplacer = strings.NewReplacer("/", "_")
+
+func flattenSegments(name string, attrs Attributes, pairs bool) string {
+	if len(attrs) == 0 {
+		return name
+	}
+
+	// Units may hold slashes (e.g., [bytes/s]), so find the last segment of the name without its unit.
+	base, _ := splitUnit(name)
+	var b strings.Builder
+	i := strings.LastIndexByte(base, '/') + 1
+	b.WriteString(base[:i])
+	for _, k := range attrs.sortedKeys() {
+		if pairs {
+			b.WriteString(segmentReplacer.Replace(k))
+			b.WriteByte('=')
+		}
+		b.WriteString(segmentReplacer.Replace(attrs[k]))
+		b.WriteByte('/')
+	}
+	b.WriteString(name[i:])
+	return b.String()
+}
+
+// SetAttributes sets the attributes describing the component, replacing any it already had. Exporters that support
+// dimensions send these with all of the component's metrics. They aren't sent to NewRelic's plugin API.
+func (c *Component) SetAttributes(attrs Attributes) {
+	attrs = attrs.clone()
+	c.agent.ops <- func(*Agent) error {
+		c.Attributes = attrs
+		return nil
+	}
+}
+
+// AddAttributedMetric adds a single value, recorded with the given attributes, to the Component. Values are aggregated
+// by name and attributes, the same as AddMetric does by name alone. If attrs is empty, this is the same as AddMetric.
+func (c *Component) AddAttributedMetric(name string, value float64, attrs Attributes) {
+	c.MergeAttributedMetric(name, ScalarMetric(value), attrs)
+}
+
+// MergeAttributedMetric merges a Metric, recorded with the given attributes, into the Component. Values are aggregated
+// by name and attributes, the same as MergeMetric does by name alone. If attrs is empty, this is the same as
+// MergeMetric.
+func (c *Component) MergeAttributedMetric(name string, value Metric, attrs Attributes) {
+	if len(attrs) == 0 {
+		c.MergeMetric(name, value)
+		return
+	}
+
+	attrs = attrs.clone()
+	key := seriesKey(name, attrs)
+	c.agent.ops <- func(*Agent) error {
+		if c.series == nil {
+			c.series = make(map[string]Series)
+		}
+		if s, ok := c.series[key]; ok {
+			s.Metric = value.Merge(s.Metric)
+			c.series[key] = s
+		} else {
+			c.series[key] = Series{Name: name, Attributes: attrs, Metric: value}
+		}
+		c.updateTiming()
+		return nil
+	}
+}
+
+// Series returns the component's metrics with their attributes, sorted by name. Metrics recorded without attributes
+// have nil Attributes. This is meant for exporters that support dimensions, so it must only be called on the
+// components of a snapshot, such as those passed to an Exporter.
+func (c *Component) Series() []Series {
+	out := make([]Series, 0, len(c.plain)+len(c.series))
+	for name, m := range c.plain {
+		out = append(out, Series{Name: name, Metric: m})
+	}
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		out = append(out, c.series[key])
+	}
+
+	// Keep series of the same name in key order, which puts the unattributed series first.
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// flatMetrics returns the metrics of the component as sent to NewRelic's plugin API, with attributed metrics flattened
+// into its plain metrics using flatten. If the component has no attributed metrics, its Metrics are returned as-is.
+// Otherwise, the result is a new map.
+func (c *Component) flatMetrics(flatten AttributeFlattener) Metrics {
+	if len(c.series) == 0 {
+		return c.Metrics
+	}
+	if flatten == nil {
+		flatten = FlattenAttributeValues
+	}
+
+	flat := make(Metrics, len(c.Metrics)+len(c.series))
+	for k, v := range c.Metrics {
+		flat[k] = v
+	}
+	for _, s := range c.series {
+		flat.AddMetric(flatten(s.Name, s.Attributes), s.Metric)
+	}
+	return flat
+}
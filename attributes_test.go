@@ -0,0 +1,127 @@
+package skunk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAttributeFlatteners(t *testing.T) {
+	db := Attributes{"role": "primary", "db": "users"}
+	tests := []struct {
+		name   string
+		attrs  Attributes
+		values string
+		pairs  string
+	}{
+		{"Component/DB/Latency[ms]", db, "Component/DB/users/primary/Latency[ms]", "Component/DB/db=users/role=primary/Latency[ms]"},
+		{"Component/DB/Latency[ms]", nil, "Component/DB/Latency[ms]", "Component/DB/Latency[ms]"},
+		{"Component/DB/Latency", db, "Component/DB/users/primary/Latency", "Component/DB/db=users/role=primary/Latency"},
+		{"Latency[ms]", db, "users/primary/Latency[ms]", "db=users/role=primary/Latency[ms]"},
+		// Slashes in units don't count as segments.
+		{"Component/Net/Rate[bytes/s]", db, "Component/Net/users/primary/Rate[bytes/s]", "Component/Net/db=users/role=primary/Rate[bytes/s]"},
+		{"Component/Net/Rate[]", db, "Component/Net/users/primary/Rate[]", "Component/Net/db=users/role=primary/Rate[]"},
+		// Slashes in attributes don't introduce segments.
+		{"Component/HTTP/Time[ms]", Attributes{"route/name": "/index"}, "Component/HTTP/_index/Time[ms]", "Component/HTTP/route_name=_index/Time[ms]"},
+	}
+	for _, tt := range tests {
+		if got := FlattenAttributeValues(tt.name, tt.attrs); got != tt.values {
+			t.Errorf("FlattenAttributeValues(%q, %v) = %q; want %q", tt.name, tt.attrs, got, tt.values)
+		}
+		if got := FlattenAttributePairs(tt.name, tt.attrs); got != tt.pairs {
+			t.Errorf("FlattenAttributePairs(%q, %v) = %q; want %q", tt.name, tt.attrs, got, tt.pairs)
+		}
+		if got := DropAttributes(tt.name, tt.attrs); got != tt.name {
+			t.Errorf("DropAttributes(%q, %v) = %q; want %q", tt.name, tt.attrs, got, tt.name)
+		}
+	}
+}
+
+func TestAttributedMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		flatten AttributeFlattener
+		want    map[string]float64
+	}{
+		{"values", nil, map[string]float64{
+			"Component/Requests[requests]":        1,
+			"Component/users/Requests[requests]":  5,
+			"Component/orders/Requests[requests]": 4,
+			"Component/Net/users/Rate[bytes/s]":   10,
+			"Component/Net/Rate[bytes/s]":         20,
+		}},
+		{"pairs", FlattenAttributePairs, map[string]float64{
+			"Component/Requests[requests]":           1,
+			"Component/db=users/Requests[requests]":  5,
+			"Component/db=orders/Requests[requests]": 4,
+			"Component/Net/db=users/Rate[bytes/s]":   10,
+			"Component/Net/Rate[bytes/s]":            20,
+		}},
+		// Dropped attributes merge values under the metric's name.
+		{"drop", DropAttributes, map[string]float64{
+			"Component/Requests[requests]": 10,
+			"Component/Net/Rate[bytes/s]":  30,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAgent(t)
+			a.FlattenAttributes = tt.flatten
+			a.Start()
+			defer a.Close()
+			com, err := a.Component("app", "com.example.app")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			users, orders := Attributes{"db": "users"}, Attributes{"db": "orders"}
+			com.AddAttributedMetric("Component/Requests[requests]", 1, nil)
+			com.AddAttributedMetric("Component/Requests[requests]", 2, users)
+			com.AddAttributedMetric("Component/Requests[requests]", 3, users)
+			com.MergeAttributedMetric("Component/Requests[requests]", CounterMetric(4), orders)
+			com.AddAttributedMetric("Component/Net/Rate[bytes/s]", 10, users)
+			com.AddAttributedMetric("Component/Net/Rate[bytes/s]", 20, Attributes{})
+
+			checkMetrics(t, unsentMetrics(t, a), tt.want)
+		})
+	}
+}
+
+func TestComponentSeries(t *testing.T) {
+	users, orders := Attributes{"db": "users"}, Attributes{"db": "orders"}
+	body := snapshotOf(t, &Body{Agent: AgentRep{Host: "host", Version: "1.0"}, Components: []*Component{{
+		Name: "app", GUID: "com.example.app", start: payloadTime.Add(-time.Minute),
+		Metrics: Metrics{
+			"Component/Requests[requests]": ScalarMetric(1),
+			"Component/Errors[errors]":     CounterMetric(2),
+		},
+		series: map[string]Series{
+			seriesKey("Component/Requests[requests]", users):  {"Component/Requests[requests]", users, ScalarMetric(5)},
+			seriesKey("Component/Requests[requests]", orders): {"Component/Requests[requests]", orders, ScalarMetric(4)},
+			seriesKey("Component/Net/Rate[bytes/s]", users):   {"Component/Net/Rate[bytes/s]", users, GaugeMetric(3)},
+		},
+	}}})
+
+	// Series are sorted by name, with the unattributed series of a name first, then by attributes. They hold the
+	// metrics as recorded, not flattened.
+	want := []Series{
+		{"Component/Errors[errors]", nil, CounterMetric(2)},
+		{"Component/Net/Rate[bytes/s]", users, GaugeMetric(3)},
+		{"Component/Requests[requests]", nil, ScalarMetric(1)},
+		{"Component/Requests[requests]", orders, ScalarMetric(4)},
+		{"Component/Requests[requests]", users, ScalarMetric(5)},
+	}
+	if got := body.Components[0].Series(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Series() = %v; want %v", got, want)
+	}
+
+	// The plugin API gets the flattened metrics.
+	checkMetrics(t, body.Components[0].Metrics, map[string]float64{
+		"Component/Errors[errors]":            2,
+		"Component/Requests[requests]":        1,
+		"Component/users/Requests[requests]":  5,
+		"Component/orders/Requests[requests]": 4,
+		"Component/Net/users/Rate[bytes/s]":   3,
+	})
+}
@@ -0,0 +1,309 @@
+package skunk
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cgroup hierarchy versions, as returned by CgroupCollector.Version.
+const (
+	CgroupV1 = 1
+	CgroupV2 = 2
+)
+
+// CgroupCollector reads container resource usage out of the cgroup filesystem and produces metrics for it. Inside of
+// a container, host-wide numbers from /proc are misleading, so this reports what the container is actually allowed and
+// using: CPU usage and throttling, memory usage, limit and OOM kills, and bytes read and written by block I/O.
+//
+// Both the unified (v2) hierarchy and the legacy (v1) per-controller hierarchies are supported. The version is
+// detected on the first collection. Metrics are named Component/Cgroup/<Metric>[<unit>]. Counters (CPU time,
+// throttling, OOM kills and I/O) are reported as the difference since the previous collection, so they're omitted
+// from the first one.
+//
+// A CgroupCollector is safe for use by multiple goroutines.
+type CgroupCollector struct {
+	// Root is the mount point of the cgroup filesystem. If empty, /sys/fs/cgroup is used.
+	Root string
+	// Path is the path of the cgroup relative to its hierarchy's root. If empty, the root cgroup is used, which is
+	// usually correct inside of a container with its own cgroup namespace.
+	Path string
+
+	mu      sync.Mutex
+	version int
+	last    cgroupSample
+}
+
+// cgroupSample holds the counters read from a cgroup for computing differences between collections. Counters that
+// couldn't be read are absent from counters.
+type cgroupSample struct {
+	when     time.Time
+	counters map[string]uint64
+}
+
+// Counter keys held by cgroupSample.
+const (
+	cgCPUUsage      = "CPU/Usage" // ns
+	cgThrottled     = "CPU/Throttled"
+	cgThrottledTime = "CPU/ThrottledTime" // ns
+	cgOOMKills      = "Memory/OOMKills"
+	cgIORead        = "IO/Read"
+	cgIOWrite       = "IO/Write"
+)
+
+// NewCgroupCollector allocates a new CgroupCollector for the cgroup filesystem mounted at /sys/fs/cgroup.
+func NewCgroupCollector() *CgroupCollector {
+	return &CgroupCollector{}
+}
+
+func (c *CgroupCollector) root() string {
+	if c.Root == "" {
+		return "/sys/fs/cgroup"
+	}
+	return c.Root
+}
+
+// Version returns the cgroup hierarchy version in use (CgroupV1 or CgroupV2). If no cgroup filesystem could be found,
+// it returns an error.
+func (c *CgroupCollector) Version() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.detect()
+}
+
+func (c *CgroupCollector) detect() (int, error) {
+	if c.version != 0 {
+		return c.version, nil
+	}
+
+	root := c.root()
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		c.version = CgroupV2
+	} else if fi, err := os.Stat(filepath.Join(root, "memory")); err == nil && fi.IsDir() {
+		c.version = CgroupV1
+	} else if fi, err := os.Stat(filepath.Join(root, "cpuacct")); err == nil && fi.IsDir() {
+		c.version = CgroupV1
+	} else {
+		return 0, mkerr(ErrNoCgroup, nil)
+	}
+	return c.version, nil
+}
+
+// Collect reads the cgroup's current resource usage and returns it as Metrics. Files missing from the cgroup (e.g.,
+// because a controller isn't enabled) are skipped.
+func (c *CgroupCollector) Collect(ctx context.Context) (Metrics, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	version, err := c.detect()
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make(Metrics)
+	cur := cgroupSample{when: time.Now(), counters: make(map[string]uint64)}
+	if version == CgroupV2 {
+		c.readV2(metrics, cur.counters)
+	} else {
+		c.readV1(metrics, cur.counters)
+	}
+
+	if len(metrics) == 0 && len(cur.counters) == 0 {
+		return nil, mkerr(ErrNoCgroup, nil)
+	}
+
+	c.addDeltas(metrics, cur)
+	c.last = cur
+	return metrics, nil
+}
+
+// addDeltas adds metrics for the difference between the counters in cur and the previous sample. Counters that went
+// backwards (e.g., because the cgroup was recreated) are skipped.
+func (c *CgroupCollector) addDeltas(metrics Metrics, cur cgroupSample) {
+	prev := c.last
+	if prev.when.IsZero() {
+		return
+	}
+
+	delta := func(key string) (float64, bool) {
+		p, ok := prev.counters[key]
+		if !ok {
+			return 0, false
+		}
+		n, ok := cur.counters[key]
+		if !ok || n < p {
+			return 0, false
+		}
+		return float64(n - p), true
+	}
+
+	if d, ok := delta(cgCPUUsage); ok {
+		if elapsed := cur.when.Sub(prev.when); elapsed > 0 {
+			metrics.AddFloat("Component/Cgroup/CPU/Usage[%]", d/float64(elapsed)*100)
+		}
+	}
+	if d, ok := delta(cgThrottled); ok {
+		metrics.AddFloat("Component/Cgroup/CPU/Throttled[periods]", d)
+	}
+	if d, ok := delta(cgThrottledTime); ok {
+		metrics.AddFloat("Component/Cgroup/CPU/ThrottledTime[ms]", d/float64(time.Millisecond))
+	}
+	if d, ok := delta(cgOOMKills); ok {
+		metrics.AddFloat("Component/Cgroup/Memory/OOMKills[events]", d)
+	}
+	if d, ok := delta(cgIORead); ok {
+		metrics.AddFloat("Component/Cgroup/IO/Read[bytes]", d)
+	}
+	if d, ok := delta(cgIOWrite); ok {
+		metrics.AddFloat("Component/Cgroup/IO/Write[bytes]", d)
+	}
+}
+
+// readV2 reads gauges into metrics and counters into counters from a unified cgroup hierarchy.
+func (c *CgroupCollector) readV2(metrics Metrics, counters map[string]uint64) {
+	dir := filepath.Join(c.root(), c.Path)
+
+	if stat, err := readKeyValues(filepath.Join(dir, "cpu.stat"), ' '); err == nil {
+		storeCounter(counters, cgCPUUsage, stat["usage_usec"], uint64(time.Microsecond))
+		storeCounter(counters, cgThrottled, stat["nr_throttled"], 1)
+		storeCounter(counters, cgThrottledTime, stat["throttled_usec"], uint64(time.Microsecond))
+	}
+
+	if n, ok := readUintFile(filepath.Join(dir, "memory.current")); ok {
+		metrics.AddFloat("Component/Cgroup/Memory/Usage[bytes]", float64(n))
+	}
+	// memory.max is "max" when there's no limit, in which case no limit is reported.
+	if n, ok := readUintFile(filepath.Join(dir, "memory.max")); ok {
+		metrics.AddFloat("Component/Cgroup/Memory/Limit[bytes]", float64(n))
+	}
+	if events, err := readKeyValues(filepath.Join(dir, "memory.events"), ' '); err == nil {
+		storeCounter(counters, cgOOMKills, events["oom_kill"], 1)
+	}
+
+	// io.stat lines look like "8:0 rbytes=1234 wbytes=5678 rios=1 wios=2 dbytes=0 dios=0", one line per device.
+	if lines, err := readLines(filepath.Join(dir, "io.stat")); err == nil {
+		var read, written uint64
+		for _, line := range lines {
+			for _, field := range strings.Fields(line) {
+				var dst *uint64
+				switch {
+				case strings.HasPrefix(field, "rbytes="):
+					dst = &read
+				case strings.HasPrefix(field, "wbytes="):
+					dst = &written
+				default:
+					continue
+				}
+				n, _ := strconv.ParseUint(field[strings.IndexByte(field, '=')+1:], 10, 64)
+				*dst += n
+			}
+		}
+		counters[cgIORead], counters[cgIOWrite] = read, written
+	}
+}
+
+// readV1 reads gauges into metrics and counters into counters from the legacy per-controller cgroup hierarchies.
+func (c *CgroupCollector) readV1(metrics Metrics, counters map[string]uint64) {
+	controller := func(names ...string) string {
+		for _, name := range names {
+			dir := filepath.Join(c.root(), name, c.Path)
+			if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+				return dir
+			}
+		}
+		return ""
+	}
+
+	if dir := controller("cpuacct", "cpu,cpuacct"); dir != "" {
+		if n, ok := readUintFile(filepath.Join(dir, "cpuacct.usage")); ok {
+			counters[cgCPUUsage] = n
+		}
+	}
+
+	if dir := controller("cpu", "cpu,cpuacct"); dir != "" {
+		if stat, err := readKeyValues(filepath.Join(dir, "cpu.stat"), ' '); err == nil {
+			storeCounter(counters, cgThrottled, stat["nr_throttled"], 1)
+			storeCounter(counters, cgThrottledTime, stat["throttled_time"], 1)
+		}
+	}
+
+	if dir := controller("memory"); dir != "" {
+		if n, ok := readUintFile(filepath.Join(dir, "memory.usage_in_bytes")); ok {
+			metrics.AddFloat("Component/Cgroup/Memory/Usage[bytes]", float64(n))
+		}
+		// An unlimited cgroup v1 reports a limit of roughly the max int64 rounded down to the page size, so
+		// anything that large is treated as no limit at all.
+		if n, ok := readUintFile(filepath.Join(dir, "memory.limit_in_bytes")); ok && n < 1<<62 {
+			metrics.AddFloat("Component/Cgroup/Memory/Limit[bytes]", float64(n))
+		}
+		if oom, err := readKeyValues(filepath.Join(dir, "memory.oom_control"), ' '); err == nil {
+			storeCounter(counters, cgOOMKills, oom["oom_kill"], 1)
+		}
+	}
+
+	// blkio lines look like "8:0 Read 1234", with a trailing "Total 1234" line.
+	if dir := controller("blkio"); dir != "" {
+		lines, err := readLines(filepath.Join(dir, "blkio.throttle.io_service_bytes"))
+		if err != nil {
+			lines, err = readLines(filepath.Join(dir, "blkio.io_service_bytes"))
+		}
+		if err == nil {
+			var read, written uint64
+			for _, line := range lines {
+				fields := strings.Fields(line)
+				if len(fields) != 3 {
+					continue
+				}
+				n, _ := strconv.ParseUint(fields[2], 10, 64)
+				switch fields[1] {
+				case "Read":
+					read += n
+				case "Write":
+					written += n
+				}
+			}
+			counters[cgIORead], counters[cgIOWrite] = read, written
+		}
+	}
+}
+
+// storeCounter parses s as an unsigned integer, multiplies it by scale, and stores it in counters under key. If s is
+// not a valid integer, nothing is stored.
+func storeCounter(counters map[string]uint64, key, s string, scale uint64) {
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		counters[key] = n * scale
+	}
+}
+
+// readUintFile reads a file containing a single unsigned integer. It returns false if the file can't be read or
+// doesn't hold an integer (e.g., "max").
+func readUintFile(name string) (uint64, bool) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	return n, err == nil
+}
+
+// readLines reads all lines of a file.
+func readLines(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,196 @@
+package skunk
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+// checkMetrics fails t if any metric in want is missing from got or has a different total, or if got has any metric
+// not in want.
+func checkMetrics(t *testing.T, got Metrics, want map[string]float64) {
+	t.Helper()
+	for name, total := range want {
+		m, ok := got[name]
+		if !ok {
+			t.Errorf("missing metric %s", name)
+			continue
+		}
+		if s, _ := summarize(m); s.Total != total {
+			t.Errorf("%s = %v; want %v", name, s.Total, total)
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			t.Errorf("unexpected metric %s = %v", name, got[name])
+		}
+	}
+}
+
+func TestCgroupCollector(t *testing.T) {
+	tests := []struct {
+		name    string
+		root    string
+		path    string
+		version int
+		want    map[string]float64
+	}{
+		{
+			name:    "v1",
+			root:    "testdata/cgroup/v1",
+			version: CgroupV1,
+			want: map[string]float64{
+				"Component/Cgroup/Memory/Usage[bytes]": 104857600,
+				"Component/Cgroup/Memory/Limit[bytes]": 268435456,
+			},
+		},
+		{
+			name:    "v2",
+			root:    "testdata/cgroup/v2",
+			version: CgroupV2,
+			want: map[string]float64{
+				// memory.max is "max", so there's no limit.
+				"Component/Cgroup/Memory/Usage[bytes]": 104857600,
+			},
+		},
+		{
+			name:    "v2 child",
+			root:    "testdata/cgroup/v2",
+			path:    "limited",
+			version: CgroupV2,
+			want: map[string]float64{
+				"Component/Cgroup/Memory/Usage[bytes]": 52428800,
+				"Component/Cgroup/Memory/Limit[bytes]": 268435456,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CgroupCollector{Root: tt.root, Path: tt.path}
+			if v, err := c.Version(); err != nil || v != tt.version {
+				t.Fatalf("Version() = %d, %v; want %d, nil", v, err, tt.version)
+			}
+
+			// Counters are only reported as differences, so the first collection has only gauges.
+			metrics, err := c.Collect(context.Background())
+			if err != nil {
+				t.Fatalf("Collect() error = %v", err)
+			}
+			checkMetrics(t, metrics, tt.want)
+		})
+	}
+}
+
+func TestCgroupCollectorDeltas(t *testing.T) {
+	tests := []struct {
+		name string
+		root string
+		// prev holds the counters of the previous sample, taken a second before the fixture's.
+		prev map[string]uint64
+		want map[string]float64
+	}{
+		{
+			name: "v1",
+			root: "testdata/cgroup/v1",
+			prev: map[string]uint64{
+				cgCPUUsage:      1500000000,
+				cgThrottled:     1,
+				cgThrottledTime: 20000000,
+				cgOOMKills:      0,
+				cgIORead:        1024,
+				cgIOWrite:       8192,
+			},
+			want: map[string]float64{
+				"Component/Cgroup/CPU/Throttled[periods]":  2,
+				"Component/Cgroup/CPU/ThrottledTime[ms]":   30,
+				"Component/Cgroup/Memory/OOMKills[events]": 1,
+				"Component/Cgroup/IO/Read[bytes]":          4096,
+				"Component/Cgroup/IO/Write[bytes]":         0,
+			},
+		},
+		{
+			name: "v2",
+			root: "testdata/cgroup/v2",
+			prev: map[string]uint64{
+				cgCPUUsage:      1500000000,
+				cgThrottled:     1,
+				cgThrottledTime: 20000000,
+				cgOOMKills:      0,
+				cgIORead:        1024,
+				cgIOWrite:       8192,
+			},
+			want: map[string]float64{
+				"Component/Cgroup/CPU/Throttled[periods]":  2,
+				"Component/Cgroup/CPU/ThrottledTime[ms]":   30,
+				"Component/Cgroup/Memory/OOMKills[events]": 1,
+				"Component/Cgroup/IO/Read[bytes]":          4096,
+				"Component/Cgroup/IO/Write[bytes]":         0,
+			},
+		},
+		{
+			// Counters that went backwards, such as after the cgroup was recreated, are skipped.
+			name: "reset",
+			root: "testdata/cgroup/v2",
+			prev: map[string]uint64{
+				cgThrottled: 100,
+				cgIORead:    1 << 40,
+			},
+			want: map[string]float64{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &CgroupCollector{Root: tt.root}
+			c.last = cgroupSample{when: time.Now().Add(-time.Second), counters: tt.prev}
+
+			metrics, err := c.Collect(context.Background())
+			if err != nil {
+				t.Fatalf("Collect() error = %v", err)
+			}
+
+			// CPU usage depends on the time between samples, so it's only checked roughly: 0.5s of CPU time over
+			// a little more than a second.
+			if _, ok := tt.prev[cgCPUUsage]; ok {
+				const name = "Component/Cgroup/CPU/Usage[%]"
+				m, ok := metrics[name]
+				if !ok {
+					t.Fatalf("missing metric %s", name)
+				}
+				if v := float64(m.(ScalarMetric)); v > 50 || v < 45 {
+					t.Errorf("%s = %v; want about 50", name, v)
+				}
+				delete(metrics, name)
+			}
+			delete(metrics, "Component/Cgroup/Memory/Usage[bytes]")
+			delete(metrics, "Component/Cgroup/Memory/Limit[bytes]")
+
+			checkMetrics(t, metrics, tt.want)
+		})
+	}
+}
+
+func TestCgroupCollectorMissing(t *testing.T) {
+	c := &CgroupCollector{Root: t.TempDir()}
+	if _, err := c.Version(); !iserr(err, ErrNoCgroup) {
+		t.Errorf("Version() error = %v; want ErrNoCgroup", err)
+	}
+	if _, err := c.Collect(context.Background()); !iserr(err, ErrNoCgroup) {
+		t.Errorf("Collect() error = %v; want ErrNoCgroup", err)
+	}
+}
+
+func TestCgroupCollectorCPUUsage(t *testing.T) {
+	// Check the CPU usage calculation exactly by controlling both samples' times.
+	c := &CgroupCollector{}
+	now := time.Now()
+	c.last = cgroupSample{when: now.Add(-2 * time.Second), counters: map[string]uint64{cgCPUUsage: 0}}
+
+	metrics := make(Metrics)
+	c.addDeltas(metrics, cgroupSample{when: now, counters: map[string]uint64{cgCPUUsage: uint64(3 * time.Second)}})
+	if v := float64(metrics["Component/Cgroup/CPU/Usage[%]"].(ScalarMetric)); math.Abs(v-150) > 1e-9 {
+		t.Errorf("CPU usage = %v; want 150", v)
+	}
+}
@@ -0,0 +1,164 @@
+package skunk
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultCollectorTimeout is the time a Collector is given to return its metrics if no timeout is given when adding it
+// to a Component.
+const DefaultCollectorTimeout = 10 * time.Second
+
+// Collector is anything that can be polled for metrics once per agent cycle. Collectors attached to a Component are run
+// by the agent just before it sends a payload, and the metrics returned are merged into the component.
+//
+// Collect should respect the deadline of the context it's given. If a collector runs past its deadline, the agent stops
+// waiting on it and discards whatever it eventually returns. If Collect returns an error, the error is logged and any
+// metrics returned alongside it are still merged into the component -- a failing collector never prevents the payload
+// from being sent.
+type Collector interface {
+	Collect(ctx context.Context) (Metrics, error)
+}
+
+// CollectorFunc is a function that implements Collector.
+type CollectorFunc func(ctx context.Context) (Metrics, error)
+
+func (fn CollectorFunc) Collect(ctx context.Context) (Metrics, error) {
+	return fn(ctx)
+}
+
+// componentCollector is a Collector attached to a component along with the time it's allowed to run for.
+type componentCollector struct {
+	Collector
+	timeout time.Duration
+	// running is set while the collector's result hasn't been merged yet. Access to this is controlled by the runloop.
+	running bool
+}
+
+// AddCollector attaches a Collector to the component. The collector is run once per agent cycle and given up to timeout
+// to return its metrics. If timeout is zero or less, DefaultCollectorTimeout is used.
+func (c *Component) AddCollector(col Collector, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultCollectorTimeout
+	}
+
+	c.agent.ops <- func(*Agent) error {
+		c.collectors = append(c.collectors, &componentCollector{Collector: col, timeout: timeout})
+		return nil
+	}
+}
+
+// collectResult is the result of running a single Collector.
+type collectResult struct {
+	com     *Component
+	col     *componentCollector
+	cycle   uint64
+	metrics Metrics
+	err     error
+}
+
+// collect starts the collectors attached to the agent's components for a new cycle, as of from, and returns the number
+// started. Up to MaxCollectors collectors run concurrently. Collectors still running from an earlier cycle aren't
+// started again. The runloop isn't held up while collectors run: each result is merged by an op of its own, and the
+// cycle ends once every collector started for it has returned or hit its deadline. This must only be called from the
+// runloop.
+func (a *Agent) collect(from time.Time) (n int) {
+	a.cycle++
+
+	for _, com := range a.body.Components {
+		for _, col := range com.collectors {
+			if col.running {
+				a.Logger.Warn("skunk: collector is still running from an earlier cycle",
+					"collector", fmt.Sprintf("%T", col.Collector),
+					"component", com.Name,
+					"guid", com.GUID)
+				continue
+			}
+			col.running = true
+			a.collectWG.Add(1)
+			go a.runCollector(com, col, a.cycle, from.Add(col.timeout))
+			n++
+		}
+	}
+	a.collecting = n
+	return n
+}
+
+// mergeCollected merges a collector's result into its component. If it's the last result the current cycle is waiting
+// on, the cycle is ended. This must only be called from the runloop.
+func (a *Agent) mergeCollected(r collectResult) {
+	r.col.running = false
+	if r.err != nil {
+		a.Logger.Warn("skunk: collector failed",
+			"collector", fmt.Sprintf("%T", r.col.Collector),
+			"component", r.com.Name,
+			"guid", r.com.GUID,
+			"error", r.err)
+		a.recordError(r.err)
+	}
+
+	if len(r.metrics) > 0 {
+		com := r.com
+		if com.start.IsZero() {
+			// Collected metrics describe the time since the last send, not since they were collected.
+			com.start = a.lastPoll
+		}
+		com.Metrics.MergeMetrics(r.metrics)
+		com.updateTiming()
+	}
+
+	// Results of earlier cycles that ended without them are merged into the current one.
+	if r.cycle == a.cycle && a.collecting > 0 {
+		if a.collecting--; a.collecting == 0 {
+			a.endCycle(time.Now())
+		}
+	}
+}
+
+// runCollector runs a single collector and sends its result to the runloop. If the agent has MaxCollectors, the
+// collector waits for a slot before running. If the deadline passes while waiting, the collector is not run at all. If
+// the deadline passes while the collector is running, its result is abandoned and the context's error is sent in its
+// place. Panics are recovered and reported as errors, since a collector shouldn't be able to take the whole agent down.
+// If the agent shuts down first, the result is dropped.
+func (a *Agent) runCollector(com *Component, col *componentCollector, cycle uint64, deadline time.Time) {
+	defer a.collectWG.Done()
+
+	ctx, cancel := context.WithDeadline(a.collectCtx, deadline)
+	defer cancel()
+
+	r := collectResult{com: com, col: col, cycle: cycle}
+	defer func() {
+		select {
+		case a.ops <- func(a *Agent) error { a.mergeCollected(r); return nil }:
+		case <-a.closing:
+		}
+	}()
+
+	if sem := a.collectSem; sem != nil {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		case <-ctx.Done():
+			r.err = ctx.Err()
+			return
+		}
+	}
+
+	done := make(chan collectResult, 1)
+	go func(r collectResult) {
+		defer func() {
+			if rc := recover(); rc != nil {
+				r.metrics, r.err = nil, mkerr(ErrCollectorPanic, fmt.Errorf("%v", rc))
+			}
+			done <- r
+		}()
+		r.metrics, r.err = col.Collect(ctx)
+	}(r)
+
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		r.err = ctx.Err()
+	}
+}
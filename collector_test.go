@@ -0,0 +1,122 @@
+package skunk
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCollectorDoesNotBlockAgent(t *testing.T) {
+	exp := newRecordingExporter()
+	a := newTestAgent(t, exp)
+	// The cycle must be long enough that the collector isn't cut off by the next one.
+	a.Cycle = 100 * time.Millisecond
+	a.Start()
+	defer a.Close()
+
+	com, err := a.Component("app", "com.example.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	com.AddCollector(CollectorFunc(func(ctx context.Context) (Metrics, error) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return Metrics{"Component/Collected[things]": ScalarMetric(1)}, nil
+	}), time.Second)
+
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("collector wasn't started")
+	}
+
+	// The agent must keep recording metrics while the collector runs.
+	done := make(chan struct{})
+	go func() {
+		com.AddMetric("Component/Recorded[things]", 2)
+		a.Status()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("agent blocked while a collector was running")
+	}
+
+	// The cycle is sent once the collector returns, with both its metrics and those recorded meanwhile.
+	close(release)
+	body := exp.wait(t, time.Second)
+	if len(body.Components) != 1 {
+		t.Fatalf("got %d components; want 1", len(body.Components))
+	}
+	checkMetrics(t, body.Components[0].Metrics, map[string]float64{
+		"Component/Collected[things]": 1,
+		"Component/Recorded[things]":  2,
+	})
+}
+
+func TestCollectorTimeout(t *testing.T) {
+	exp := newRecordingExporter()
+	a := newTestAgent(t, exp)
+	a.Cycle = 20 * time.Millisecond
+	a.Start()
+	defer a.Close()
+
+	com, err := a.Component("app", "com.example.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	com.AddCollector(CollectorFunc(func(ctx context.Context) (Metrics, error) {
+		<-ctx.Done()
+		return Metrics{"Component/Late[things]": ScalarMetric(1)}, nil
+	}), 10*time.Millisecond)
+	com.AddCollector(CollectorFunc(func(ctx context.Context) (Metrics, error) {
+		return Metrics{"Component/OnTime[things]": ScalarMetric(1)}, nil
+	}), 0)
+
+	// The collector that hits its deadline is dropped, and the cycle is sent without it.
+	body := exp.wait(t, time.Second)
+	checkMetrics(t, body.Components[0].Metrics, map[string]float64{"Component/OnTime[things]": 1})
+	if err := a.Err(); err != nil {
+		t.Errorf("Err() = %v; collector errors shouldn't be kept as the agent's error", err)
+	}
+}
+
+func TestCollectorCloseWhileRunning(t *testing.T) {
+	a := newTestAgent(t)
+	a.Cycle = 10 * time.Millisecond
+	a.Start()
+
+	com, err := a.Component("app", "com.example.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{}, 1)
+	com.AddCollector(CollectorFunc(func(ctx context.Context) (Metrics, error) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}), time.Hour)
+	<-started
+
+	// Close cancels running collectors rather than waiting out their deadlines.
+	closed := make(chan struct{})
+	go func() {
+		a.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waited on a running collector")
+	}
+}
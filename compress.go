@@ -0,0 +1,93 @@
+package skunk
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"sync"
+)
+
+// Compression is the algorithm an agent compresses its payloads with.
+type Compression int
+
+const (
+	// GzipCompression compresses payloads with gzip. This is the default.
+	GzipCompression Compression = iota
+	// DeflateCompression compresses payloads with zlib-wrapped DEFLATE (HTTP's "deflate" content encoding).
+	DeflateCompression
+	// NoCompression sends payloads uncompressed. This is mostly useful for reading payloads through a debugging proxy.
+	NoCompression
+)
+
+// contentEncoding returns the Content-Encoding header value for payloads compressed with c. It returns the empty string
+// for NoCompression.
+func (c Compression) contentEncoding() string {
+	switch c {
+	case GzipCompression:
+		return "gzip"
+	case DeflateCompression:
+		return "deflate"
+	}
+	return ""
+}
+
+func (c Compression) String() string {
+	if enc := c.contentEncoding(); enc != "" {
+		return enc
+	}
+	return "none"
+}
+
+// compressor is a pooled gzip.Writer or zlib.Writer.
+type compressor interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// compressorPools holds pooled compressors for each compression algorithm and level, indexed by Compression and then
+// level-flate.HuffmanOnly.
+var compressorPools [NoCompression][flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+// compressionLevel returns level if it's a valid compression level other than flate.NoCompression, and
+// flate.DefaultCompression otherwise.
+func compressionLevel(level int) int {
+	if level == flate.NoCompression || level < flate.HuffmanOnly || level > flate.BestCompression {
+		return flate.DefaultCompression
+	}
+	return level
+}
+
+// getCompressor returns a pooled compressor for c at the given level, writing to w. c must not be NoCompression, and
+// level must already have been passed through compressionLevel. Return it with putCompressor once closed.
+func getCompressor(c Compression, level int, w io.Writer) compressor {
+	if zw, ok := compressorPools[c][level-flate.HuffmanOnly].Get().(compressor); ok {
+		zw.Reset(w)
+		return zw
+	}
+
+	// Levels are validated by compressionLevel, so neither of these can fail.
+	if c == DeflateCompression {
+		zw, _ := zlib.NewWriterLevel(w, level)
+		return zw
+	}
+	zw, _ := gzip.NewWriterLevel(w, level)
+	return zw
+}
+
+func putCompressor(c Compression, level int, zw compressor) {
+	// Drop the reference to the last writer so it isn't kept alive by the pool.
+	zw.Reset(nil)
+	compressorPools[c][level-flate.HuffmanOnly].Put(zw)
+}
+
+// compress writes the data written by write to w, compressed with c at the given level.
+func compress(w io.Writer, c Compression, level int, write func(io.Writer) error) (err error) {
+	level = compressionLevel(level)
+	zw := getCompressor(c, level, w)
+	defer putCompressor(c, level, zw)
+	if err = write(zw); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,131 @@
+package skunk
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// decompress returns the data in r, decompressed according to the Content-Encoding enc.
+func decompress(t *testing.T, enc string, r io.Reader) []byte {
+	t.Helper()
+	var err error
+	switch enc {
+	case "gzip":
+		r, err = gzip.NewReader(r)
+	case "deflate":
+		r, err = zlib.NewReader(r)
+	case "":
+	default:
+		t.Fatalf("unexpected Content-Encoding %q", enc)
+	}
+	if err != nil {
+		t.Fatalf("invalid %s data: %v", enc, err)
+	}
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("invalid %s data: %v", enc, err)
+	}
+	return p
+}
+
+func TestCompress(t *testing.T) {
+	data := []byte(strings.Repeat("Component/HTTP/GET/Requests[requests] ", 100))
+	levels := []int{0, flate.HuffmanOnly, flate.BestSpeed, flate.BestCompression, flate.NoCompression, 42, -42}
+
+	for _, c := range []Compression{GzipCompression, DeflateCompression} {
+		for _, level := range levels {
+			// Compress twice so the second uses a pooled compressor, which mustn't carry over the first's output.
+			for i := 0; i < 2; i++ {
+				t.Run(fmt.Sprintf("%v/level %d/%d", c, level, i), func(t *testing.T) {
+					var buf bytes.Buffer
+					err := compress(&buf, c, level, func(w io.Writer) error {
+						_, err := w.Write(data)
+						return err
+					})
+					if err != nil {
+						t.Fatalf("compress() error = %v", err)
+					}
+					if got := decompress(t, c.contentEncoding(), &buf); !bytes.Equal(got, data) {
+						t.Errorf("decompressed %q; want %q", got, data)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestCompressWriteError(t *testing.T) {
+	errWrite := errors.New("write failed")
+	err := compress(ioutil.Discard, GzipCompression, 0, func(io.Writer) error { return errWrite })
+	if err != errWrite {
+		t.Errorf("compress() error = %v; want %v", err, errWrite)
+	}
+}
+
+func TestPayloadCompression(t *testing.T) {
+	type request struct {
+		encoding string
+		body     []byte
+	}
+	requests := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := ioutil.ReadAll(r.Body)
+		requests <- request{r.Header.Get("Content-Encoding"), p}
+	}))
+	defer srv.Close()
+
+	body := spanBody(t, payloadTime, payloadTime.Add(time.Minute), 3)
+	var plain bytes.Buffer
+	if _, err := newTestAgent(t).getPayload(&plain, body, NoCompression); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		compression Compression
+		threshold   int
+		want        string
+	}{
+		{"gzip", GzipCompression, 0, "gzip"},
+		{"deflate", DeflateCompression, 0, "deflate"},
+		{"none", NoCompression, 0, ""},
+		{"gzip below threshold", GzipCompression, plain.Len() + 1, ""},
+		{"gzip at threshold", GzipCompression, plain.Len(), "gzip"},
+		{"deflate below threshold", DeflateCompression, plain.Len() + 1, ""},
+		{"deflate above threshold", DeflateCompression, plain.Len() - 1, "deflate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAgent(t)
+			a.Compression = tt.compression
+			a.CompressionThreshold = tt.threshold
+			a.CompressionLevel = flate.BestSpeed
+			if err := a.sendRequest(context.Background(), body, srv.URL, "key"); err != nil {
+				t.Fatalf("sendRequest() error = %v", err)
+			}
+
+			req := <-requests
+			if req.encoding != tt.want {
+				t.Errorf("Content-Encoding = %q; want %q", req.encoding, tt.want)
+			}
+			got := decompress(t, req.encoding, bytes.NewReader(req.body))
+			if !bytes.Equal(got, plain.Bytes()) || !json.Valid(got) {
+				t.Errorf("payload = %s; want %s", got, plain.Bytes())
+			}
+		})
+	}
+}
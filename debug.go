@@ -0,0 +1,214 @@
+package skunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MaxErrorHistory is the number of errors an agent remembers for Status. Older errors are discarded.
+const MaxErrorHistory = 16
+
+// ErrorRecord is an error encountered by an agent's runloop and the time it was encountered.
+type ErrorRecord struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// ComponentStatus describes a component held by an agent.
+type ComponentStatus struct {
+	Name       string `json:"name"`
+	GUID       string `json:"guid"`
+	Account    string `json:"account,omitempty"`
+	Metrics    int    `json:"metrics"`
+	Collectors int    `json:"collectors"`
+}
+
+// Status describes the state of an agent's runloop, as returned by Agent.Status.
+type Status struct {
+	Agent AgentRep `json:"agent"`
+	Cycle Seconds  `json:"cycle"`
+	// LastSend, LastAttempt, LastError, Retrying, and NextRetry describe the agent's first destination: NewRelic's
+	// plugin API or, if DisablePluginAPI is set, its first exporter. See DestinationStatus for what they mean. If the
+	// agent has no destinations, LastSend is the time metrics were last handed off and the rest are zero.
+	LastSend    time.Time `json:"last_send"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Retrying    bool      `json:"retrying"`
+	NextRetry   time.Time `json:"next_retry"`
+	NextTick    time.Time `json:"next_tick"`
+	// Destinations describes each of the destinations the agent sends metrics to, in order.
+	Destinations []DestinationStatus `json:"destinations"`
+	// Errors is the list of the most recent errors encountered by the agent, oldest first.
+	Errors     []ErrorRecord     `json:"errors"`
+	Components []ComponentStatus `json:"components"`
+	// Unsent holds the metrics collected since they were last handed to the agent's destinations.
+	Unsent *Body `json:"unsent"`
+	// UnsentEvents is the number of events recorded that haven't been sent yet.
+	UnsentEvents int `json:"unsent_events"`
+}
+
+// recordError adds err to the agent's error history.
+func (a *Agent) recordError(err error) {
+	a.errMu.Lock()
+	defer a.errMu.Unlock()
+
+	if len(a.errHistory) == MaxErrorHistory {
+		copy(a.errHistory, a.errHistory[1:])
+		a.errHistory = a.errHistory[:MaxErrorHistory-1]
+	}
+	a.errHistory = append(a.errHistory, ErrorRecord{time.Now(), err.Error()})
+}
+
+// Status returns the current state of the agent. The agent must be running.
+func (a *Agent) Status() *Status {
+	out := make(chan *Status)
+	a.ops <- func(a *Agent) error {
+		out <- a.status(time.Now())
+		return nil
+	}
+	return <-out
+}
+
+// tryStatus returns the agent's Status if it's running. Like trySnapshot, it neither blocks nor panics otherwise.
+func (a *Agent) tryStatus() (*Status, bool) {
+	out := make(chan *Status, 1)
+	if !a.tryOp(func(a *Agent) error { out <- a.status(time.Now()); return nil }) {
+		return nil, false
+	}
+	return <-out, true
+}
+
+func (a *Agent) status(now time.Time) *Status {
+	st := &Status{
+		Agent:        a.body.Agent,
+		Cycle:        Seconds{a.Cycle},
+		LastSend:     a.lastPoll,
+		NextTick:     a.nextTick,
+		Destinations: make([]DestinationStatus, len(a.destinations)),
+		Components:   make([]ComponentStatus, len(a.body.Components)),
+		Unsent:       a.snapshot(now),
+		UnsentEvents: len(a.events) + a.eventSender.unsent(),
+	}
+
+	a.errMu.Lock()
+	st.Errors = append([]ErrorRecord(nil), a.errHistory...)
+	a.errMu.Unlock()
+
+	for i, d := range a.destinations {
+		st.Destinations[i] = d.status()
+	}
+	if len(st.Destinations) > 0 {
+		first := st.Destinations[0]
+		st.LastSend, st.LastAttempt, st.LastError = first.LastSend, first.LastAttempt, first.LastError
+		st.Retrying, st.NextRetry = first.Retrying, first.NextRetry
+	}
+	for i, com := range a.body.Components {
+		st.Components[i] = ComponentStatus{
+			Name:       com.Name,
+			GUID:       com.GUID,
+			Account:    com.account,
+			Metrics:    len(com.Metrics) + len(com.series),
+			Collectors: len(com.collectors),
+		}
+	}
+	return st
+}
+
+// DebugHandler returns an http.Handler that shows the agent's Status. It responds with an HTML page by default, or with
+// JSON if the request has a format=json query parameter or accepts application/json. The unsent metrics are shown in
+// the same table written to the agent's log by TableFormat. The handler may be mounted anywhere, such as
+// /debug/skunk. If the agent isn't running, because it hasn't been started or has been closed, the handler responds with
+// 503 Service Unavailable.
+func (a *Agent) DebugHandler() http.Handler {
+	return debugHandler{a}
+}
+
+type debugHandler struct {
+	agent *Agent
+}
+
+func (h debugHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	st, ok := h.agent.tryStatus()
+	if !ok {
+		http.Error(w, "skunk agent is not running", http.StatusServiceUnavailable)
+		return
+	}
+	if req.URL.Query().Get("format") == "json" || strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(st)
+		return
+	}
+
+	var table bytes.Buffer
+	TableFormat.FormatMetrics(&table, st.Unsent.Components)
+
+	var page bytes.Buffer
+	err := debugTemplate.Execute(&page, struct {
+		*Status
+		Table string
+	}{st, table.String()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	page.WriteTo(w)
+}
+
+var debugTemplate = template.Must(template.New("debug").Funcs(template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>skunk: {{.Agent.Host}}</title></head>
+<body>
+<h1>skunk agent {{.Agent.Host}} (pid {{.Agent.PID}}, version {{.Agent.Version}})</h1>
+<table>
+<tr><th align="left">Cycle</th><td>{{.Cycle.Duration}}</td></tr>
+<tr><th align="left">Last send</th><td>{{time .LastSend}}</td></tr>
+<tr><th align="left">Last attempt</th><td>{{time .LastAttempt}}</td></tr>
+<tr><th align="left">Last error</th><td>{{or .LastError "none"}}</td></tr>
+<tr><th align="left">Retrying</th><td>{{if .Retrying}}yes, at {{time .NextRetry}}{{else}}no{{end}}</td></tr>
+<tr><th align="left">Next tick</th><td>{{time .NextTick}}</td></tr>
+<tr><th align="left">Unsent events</th><td>{{.UnsentEvents}}</td></tr>
+</table>
+
+<h2>Destinations</h2>
+<table>
+<tr><th align="left">Name</th><th align="left">Last send</th><th align="left">Last error</th><th align="left">Retrying</th><th align="right">Pending</th><th align="right">Dropped</th></tr>
+{{range .Destinations}}<tr><td>{{.Name}}</td><td>{{time .LastSend}}</td><td>{{or .LastError "none"}}</td><td>{{if .Retrying}}yes, at {{time .NextRetry}}{{else}}no{{end}}</td><td align="right">{{.Pending}}</td><td align="right">{{.Dropped}}</td></tr>
+{{end}}</table>
+
+<h2>Components</h2>
+<table>
+<tr><th align="left">Name</th><th align="left">GUID</th><th align="left">Account</th><th align="right">Metrics</th><th align="right">Collectors</th></tr>
+{{range .Components}}<tr><td>{{.Name}}</td><td>{{.GUID}}</td><td>{{or .Account "default"}}</td><td align="right">{{.Metrics}}</td><td align="right">{{.Collectors}}</td></tr>
+{{end}}</table>
+
+<h2>Unsent metrics</h2>
+<pre>{{or .Table "none"}}</pre>
+
+<h2>Errors</h2>
+{{if .Errors}}<table>
+{{range .Errors}}<tr><td>{{time .Time}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>{{else}}<p>none</p>{{end}}
+</body>
+</html>
+`))
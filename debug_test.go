@@ -0,0 +1,106 @@
+package skunk
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	a := newTestAgent(t, newRecordingExporter())
+	a.Start()
+	defer a.Close()
+	com, err := a.Component("web<b>", "com.example.web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	com.AddMetric("Component/Requests[requests]", 3)
+	h := a.DebugHandler()
+
+	t.Run("html", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/skunk", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d; want 200", rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		page := rec.Body.String()
+		for _, want := range []string{
+			"skunk agent host (pid 1, version 1.0)",
+			"<td>*skunk.recordingExporter</td>",
+			// Names are escaped.
+			"<td>web&lt;b&gt;</td><td>com.example.web</td><td>default</td>",
+			"Component/Requests[requests]",
+		} {
+			if !strings.Contains(page, want) {
+				t.Errorf("page missing %q:\n%s", want, page)
+			}
+		}
+	})
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/debug/skunk?format=json", nil),
+		func() *http.Request {
+			req := httptest.NewRequest("GET", "/debug/skunk", nil)
+			req.Header.Set("Accept", "application/json")
+			return req
+		}(),
+	} {
+		t.Run("json "+req.URL.RawQuery, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+
+			var st struct {
+				Agent        AgentRep            `json:"agent"`
+				Destinations []DestinationStatus `json:"destinations"`
+				Components   []ComponentStatus   `json:"components"`
+				Unsent       struct {
+					Components []struct {
+						Metrics map[string]float64 `json:"metrics"`
+					} `json:"components"`
+				} `json:"unsent"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+				t.Fatalf("invalid JSON %s: %v", rec.Body.String(), err)
+			}
+			if st.Agent.Host != "host" || len(st.Destinations) != 1 || len(st.Components) != 1 ||
+				st.Components[0].Metrics != 1 || len(st.Unsent.Components) != 1 ||
+				st.Unsent.Components[0].Metrics["Component/Requests[requests]"] != 3 {
+				t.Errorf("status = %s", rec.Body.String())
+			}
+		})
+	}
+
+	t.Run("method", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/debug/skunk", nil))
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("status = %d, Allow = %q; want 405, GET, HEAD", rec.Code, rec.Header().Get("Allow"))
+		}
+	})
+}
+
+func TestDebugHandlerNotRunning(t *testing.T) {
+	a := newTestAgent(t)
+	h := a.DebugHandler()
+
+	check := func(when string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/skunk", nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: status = %d; want 503", when, rec.Code)
+		}
+	}
+
+	check("before Start")
+	a.Start()
+	a.Close()
+	check("after Close")
+}
@@ -0,0 +1,398 @@
+package skunk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultExportTimeout is the time an agent gives NewRelic's plugin API, and any exporter added without a timeout, to
+// accept a send.
+const DefaultExportTimeout = 30 * time.Second
+
+// DefaultMaxBacklog is the default longest span of metrics a destination holds onto while it fails to send them.
+const DefaultMaxBacklog = time.Hour
+
+// retryDelay is the time a destination waits before retrying a failed send.
+const retryDelay = time.Minute
+
+// destination is somewhere an agent sends its metrics: NewRelic's plugin API or one of its exporters. Every cycle, the
+// agent hands each destination the same snapshot of its metrics and clears them. Each destination sends from its own
+// goroutine and keeps its own backlog of metrics it failed to send, so one that's failing or slow doesn't hold up or
+// lose metrics for the others.
+//
+// If a send fails because the destination is unavailable or unreachable (errMustRetry or any error that isn't an
+// *Error), its metrics are kept and merged with any received since, and the send is retried after retryDelay. Other
+// errors mean the destination rejected the metrics, so they're dropped. So that a destination that's down for a long
+// time doesn't hold onto its metrics forever, once its backlog spans more than maxBacklog, the older metrics are dropped.
+type destination struct {
+	name       string
+	exp        Exporter
+	timeout    time.Duration
+	maxBacklog time.Duration
+	agent      *Agent
+	// primary is set for the account of the agent's own license key on NewRelic's plugin API or, if that's disabled,
+	// the agent's first exporter. Its rejections are kept as the agent's Err.
+	primary bool
+	// inline destinations are sent to from the runloop instead of their own goroutine. They're retried on the next
+	// cycle rather than after retryDelay.
+	inline bool
+
+	// signal is sent on, without blocking, when there are metrics to send or the destination is closing.
+	signal chan struct{}
+	// done is closed once the destination's goroutine has made its final send and exited.
+	done chan struct{}
+
+	mu          sync.Mutex
+	pending     *Body
+	closing     bool
+	lastSend    time.Time
+	lastAttempt time.Time
+	lastErr     error
+	retrying    bool
+	nextRetry   time.Time
+	dropped     int
+}
+
+// DestinationStatus describes one of the destinations an agent sends metrics to.
+type DestinationStatus struct {
+	// Name is the name of the destination: "NewRelic" for NewRelic's plugin API, "NewRelic (name)" for the named
+	// account in the agent's Accounts, or the type of an exporter.
+	Name string `json:"name"`
+	// LastSend is the time metrics were last successfully sent, or the time the agent was started if none have been.
+	LastSend time.Time `json:"last_send"`
+	// LastAttempt is the time of the last attempt to send metrics, successful or not. It is zero if no attempt has
+	// been made yet.
+	LastAttempt time.Time `json:"last_attempt"`
+	// LastError is the error returned by the last attempt to send metrics, if it failed.
+	LastError string `json:"last_error,omitempty"`
+	// Retrying is true if the last attempt failed because the destination was unavailable and it will be retried at
+	// NextRetry.
+	Retrying  bool      `json:"retrying"`
+	NextRetry time.Time `json:"next_retry"`
+	// Pending is the number of metrics waiting to be sent, such as those held for a retry.
+	Pending int `json:"pending"`
+	// Dropped is the number of metrics dropped without being sent, because the destination rejected them, they were
+	// held for longer than the agent's MaxBacklog, or the destination was unavailable on shutdown.
+	Dropped int `json:"dropped"`
+}
+
+func newDestination(a *Agent, name string, exp Exporter, timeout time.Duration) *destination {
+	if timeout <= 0 {
+		timeout = DefaultExportTimeout
+	}
+	maxBacklog := a.MaxBacklog
+	if maxBacklog <= 0 {
+		maxBacklog = DefaultMaxBacklog
+	}
+	_, inline := exp.(inlineExporter)
+	return &destination{
+		name:       name,
+		exp:        exp,
+		timeout:    timeout,
+		maxBacklog: maxBacklog,
+		agent:      a,
+		inline:     inline,
+		signal:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		lastSend:   a.lastPoll,
+	}
+}
+
+// inlineExporter is implemented by exporters that only hold metrics in memory, so they can't fail or take long to
+// export. They're exported to from the runloop, so that their metrics are never absent from both the agent and the
+// exporter.
+type inlineExporter interface {
+	Exporter
+	exportsInline()
+}
+
+// AddExporter adds an exporter to the agent's destinations. It receives the agent's metrics from the next cycle on,
+// and is given up to timeout to accept each send. If timeout is zero or less, DefaultExportTimeout is used. The agent
+// must be running; to add exporters before it starts, use Exporters.
+func (a *Agent) AddExporter(exp Exporter, timeout time.Duration) {
+	a.ops <- func(a *Agent) error {
+		a.addDestination(fmt.Sprintf("%T", exp), exp, timeout)
+		return nil
+	}
+}
+
+// addDestination adds and starts a destination. This must only be called from the runloop.
+func (a *Agent) addDestination(name string, exp Exporter, timeout time.Duration) {
+	d := newDestination(a, name, exp, timeout)
+	if p, ok := exp.(pluginExporter); ok {
+		// Other accounts' rejections are only logged and kept in their status.
+		d.primary = p.accounts[""]
+	} else {
+		d.primary = len(a.destinations) == 0
+	}
+	a.destinations = append(a.destinations, d)
+	if d.inline {
+		close(d.done)
+		return
+	}
+	go d.run()
+}
+
+// enqueue adds body to the metrics waiting to be sent to the destination. Inline destinations are sent to right away.
+// body must not be modified afterward.
+func (d *destination) enqueue(body *Body) {
+	if p, ok := d.exp.(pluginExporter); ok {
+		// Only hold onto the components routed to the plugin API account.
+		if body = p.route(body); body == nil {
+			return
+		}
+	}
+
+	d.mu.Lock()
+	d.pending = d.merge(d.pending, body)
+	if d.inline {
+		body, d.pending = d.pending, nil
+		d.mu.Unlock()
+		d.send(body, false)
+		return
+	}
+	d.mu.Unlock()
+	d.notify()
+}
+
+// merge returns the metrics of newer merged into older, as mergeBodies does. If they'd span more than the destination's
+// maxBacklog, older is dropped instead. This must only be called with d.mu held.
+func (d *destination) merge(older, newer *Body) *Body {
+	if older == nil || newer == nil || bodyEnd(newer).Sub(bodyStart(older)) <= d.maxBacklog {
+		return mergeBodies(older, newer)
+	}
+
+	n := bodyMetrics(older)
+	d.dropped += n
+	d.agent.Logger.Warn("skunk: destination backlog is too old - dropping metrics on the floor",
+		"destination", d.name, "max_backlog", d.maxBacklog, "metrics", n)
+	return newer
+}
+
+// close tells the destination to make a final attempt at sending its pending metrics and stop.
+func (d *destination) close() {
+	d.mu.Lock()
+	d.closing = true
+	d.mu.Unlock()
+	d.notify()
+}
+
+func (d *destination) notify() {
+	select {
+	case d.signal <- struct{}{}:
+	default:
+	}
+}
+
+// run sends metrics to the destination as they're enqueued, until it's closed.
+func (d *destination) run() {
+	defer close(d.done)
+
+	timer := time.NewTimer(retryDelay)
+	timer.Stop()
+	for {
+		select {
+		case <-d.signal:
+		case <-timer.C:
+		}
+
+		d.mu.Lock()
+		if d.retrying && time.Now().Before(d.nextRetry) && !d.closing {
+			// Hold onto new metrics until it's time to retry.
+			d.mu.Unlock()
+			continue
+		}
+		body, closing := d.pending, d.closing
+		d.pending = nil
+		d.mu.Unlock()
+
+		if body != nil && d.send(body, closing) {
+			timer.Reset(retryDelay)
+		}
+		if closing {
+			return
+		}
+	}
+}
+
+// send exports body to the destination and handles any error. If final is set, metrics are dropped rather than kept
+// for a retry. It returns true if the send must be retried.
+func (d *destination) send(body *Body, final bool) (retry bool) {
+	ctx, cancel := context.WithTimeout(WithoutMetrics(context.Background()), d.timeout)
+	start := time.Now()
+	err := d.exp.Export(ctx, body)
+	cancel()
+
+	a := d.agent
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lastAttempt, d.lastErr, d.retrying = start, err, false
+	if err == nil {
+		d.lastSend = start
+		return false
+	}
+
+	a.recordError(err)
+	if _, ok := err.(*Error); !ok || iserr(err, errMustRetry) {
+		if final {
+			d.dropped += bodyMetrics(body)
+			a.Logger.Warn("skunk: destination is unavailable on shutdown flush - dropping metrics on the floor",
+				"destination", d.name, "error", err)
+			return false
+		}
+		d.pending = d.merge(body, d.pending)
+		d.retrying, d.nextRetry = true, start.Add(retryDelay)
+		a.Logger.Warn("skunk: destination is unavailable, retrying send",
+			"destination", d.name, "retry_delay", retryDelay, "error", err)
+		return !d.inline
+	}
+
+	if d.primary {
+		a.setErr(err)
+	}
+	d.dropped += bodyMetrics(body)
+	a.Logger.Error("skunk: destination rejected metrics", "destination", d.name, "error", err)
+	return false
+}
+
+func (d *destination) status() DestinationStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	st := DestinationStatus{
+		Name:        d.name,
+		LastSend:    d.lastSend,
+		LastAttempt: d.lastAttempt,
+		Retrying:    d.retrying,
+		Pending:     bodyMetrics(d.pending),
+		Dropped:     d.dropped,
+	}
+	if d.lastErr != nil {
+		st.LastError = d.lastErr.Error()
+	}
+	if d.retrying {
+		st.NextRetry = d.nextRetry
+	}
+	return st
+}
+
+// dispatch hands a snapshot of the agent's metrics, as of from, to each of its destinations and clears them. This must
+// only be called from the runloop.
+func (a *Agent) dispatch(from time.Time) {
+	body := a.snapshot(from)
+	a.lastPoll = from
+	a.clear()
+	if len(body.Components) == 0 {
+		return
+	}
+
+	if a.NonFinite == ReportNonFinite {
+		for _, com := range body.Components {
+			if m, ok := com.Metrics[NonFiniteMetric]; ok {
+				s, _ := summarize(m)
+				a.Logger.Warn("skunk: dropped metrics with non-finite values",
+					"component", com.Name,
+					"guid", com.GUID,
+					"metrics", s.Total)
+			}
+		}
+	}
+
+	for _, d := range a.destinations {
+		d.enqueue(body)
+	}
+}
+
+// mergeBodies returns the metrics of newer merged into older. Neither body is modified, so the result may share
+// components and metrics with either. If either is nil, the other is returned.
+func mergeBodies(older, newer *Body) *Body {
+	switch {
+	case older == nil:
+		return newer
+	case newer == nil:
+		return older
+	}
+
+	merged := &Body{Agent: newer.Agent, Components: append([]*Component(nil), older.Components...)}
+	index := make(map[string]int, len(merged.Components))
+	for i, com := range merged.Components {
+		index[com.Name+"\x00"+com.GUID] = i
+	}
+	for _, com := range newer.Components {
+		if i, ok := index[com.Name+"\x00"+com.GUID]; ok {
+			merged.Components[i] = mergeComponents(merged.Components[i], com)
+		} else {
+			merged.Components = append(merged.Components, com)
+		}
+	}
+	return merged
+}
+
+// mergeComponents returns a new component holding the metrics of newer merged into older, spanning the time from the
+// start of older to the end of newer. Both must be components of snapshots.
+func mergeComponents(older, newer *Component) *Component {
+	merged := &Component{
+		Name:       newer.Name,
+		GUID:       newer.GUID,
+		Attributes: newer.Attributes,
+		Metrics:    copyMetrics(older.Metrics),
+		start:      older.start,
+		account:    newer.account,
+	}
+	merged.Metrics.MergeMetrics(newer.Metrics)
+	merged.Duration.Duration = newer.start.Add(newer.Duration.Duration).Sub(merged.start)
+
+	if len(older.series) == 0 && len(newer.series) == 0 {
+		merged.plain = merged.Metrics
+		return merged
+	}
+
+	merged.plain = copyMetrics(older.plain)
+	merged.plain.MergeMetrics(newer.plain)
+	merged.series = make(map[string]Series, len(older.series)+len(newer.series))
+	for key, s := range older.series {
+		merged.series[key] = s
+	}
+	for key, s := range newer.series {
+		if old, ok := merged.series[key]; ok {
+			s.Metric = s.Metric.Merge(old.Metric)
+		}
+		merged.series[key] = s
+	}
+	return merged
+}
+
+// bodyStart returns the time the metrics of a snapshot were gathered from.
+func bodyStart(body *Body) (start time.Time) {
+	for i, com := range body.Components {
+		if i == 0 || com.start.Before(start) {
+			start = com.start
+		}
+	}
+	return start
+}
+
+// bodyMetrics returns the number of metrics in a snapshot, counting each series of a metric recorded with attributes.
+// body may be nil.
+func bodyMetrics(body *Body) (n int) {
+	if body == nil {
+		return 0
+	}
+	for _, com := range body.Components {
+		n += len(com.plain) + len(com.series)
+	}
+	return n
+}
+
+// bodyEnd returns the time the metrics of a snapshot were gathered up to.
+func bodyEnd(body *Body) (end time.Time) {
+	for _, com := range body.Components {
+		if t := com.start.Add(com.Duration.Duration); t.After(end) {
+			end = t
+		}
+	}
+	return end
+}
@@ -0,0 +1,167 @@
+package skunk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingExporter is an Exporter that fails every send with err.
+type failingExporter struct{ err error }
+
+func (e failingExporter) Export(context.Context, *Body) error { return e.err }
+
+// spanBody returns a snapshot of a single component holding the given number of metrics, gathered from from to to.
+func spanBody(t *testing.T, from, to time.Time, metrics int) *Body {
+	com := &Component{Name: "app", GUID: "com.example.app", start: from, Metrics: make(Metrics)}
+	for i := 0; i < metrics; i++ {
+		com.Metrics[string(rune('A'+i))] = ScalarMetric(1)
+	}
+	a := newTestAgent(t)
+	a.body.Components = []*Component{com}
+	return a.snapshot(to)
+}
+
+func TestDestinationBacklogLimit(t *testing.T) {
+	a := newTestAgent(t)
+	a.MaxBacklog = 2 * time.Minute
+	d := newDestination(a, "failing", failingExporter{errors.New("unreachable")}, time.Second)
+
+	t0 := payloadTime
+	if !d.send(spanBody(t, t0, t0.Add(time.Minute), 2), false) {
+		t.Fatal("send() = false; want a retry")
+	}
+
+	// Metrics spanning up to MaxBacklog are held together.
+	d.enqueue(spanBody(t, t0.Add(time.Minute), t0.Add(2*time.Minute), 3))
+	if st := d.status(); st.Pending != 3 || st.Dropped != 0 {
+		t.Errorf("Pending = %d, Dropped = %d; want 3, 0", st.Pending, st.Dropped)
+	}
+
+	// Past that, the older metrics are dropped.
+	d.enqueue(spanBody(t, t0.Add(2*time.Minute), t0.Add(3*time.Minute), 1))
+	if st := d.status(); st.Pending != 1 || st.Dropped != 3 {
+		t.Errorf("Pending = %d, Dropped = %d; want 1, 3", st.Pending, st.Dropped)
+	}
+	if start := bodyStart(d.pending); !start.Equal(t0.Add(2 * time.Minute)) {
+		t.Errorf("pending from %v; want %v", start, t0.Add(2*time.Minute))
+	}
+
+	// The backlog is also checked when a retried send fails again.
+	body := d.pending
+	d.pending = spanBody(t, t0.Add(5*time.Minute), t0.Add(6*time.Minute), 2)
+	d.send(body, false)
+	if st := d.status(); st.Pending != 2 || st.Dropped != 4 {
+		t.Errorf("Pending = %d, Dropped = %d; want 2, 4", st.Pending, st.Dropped)
+	}
+}
+
+func TestDestinationDroppedCounts(t *testing.T) {
+	a := newTestAgent(t)
+	body := spanBody(t, payloadTime, payloadTime.Add(time.Minute), 2)
+
+	// Rejected metrics are dropped.
+	d := newDestination(a, "rejecting", failingExporter{mkerr(ErrBadPayload, nil)}, time.Second)
+	if d.send(body, false) {
+		t.Error("send() = true; want no retry for a rejection")
+	}
+	if st := d.status(); st.Dropped != 2 || st.Pending != 0 {
+		t.Errorf("rejected: Pending = %d, Dropped = %d; want 0, 2", st.Pending, st.Dropped)
+	}
+
+	// So are metrics a destination is unavailable for on shutdown.
+	d = newDestination(a, "failing", failingExporter{errors.New("unreachable")}, time.Second)
+	d.send(body, true)
+	if st := d.status(); st.Dropped != 2 || st.Pending != 0 {
+		t.Errorf("shutdown: Pending = %d, Dropped = %d; want 0, 2", st.Pending, st.Dropped)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		status int
+		code   int // The expected error code, or -1 for a plain error.
+	}{
+		{http.StatusOK, 0},
+		{http.StatusAccepted, 0},
+		{http.StatusNoContent, 0},
+		{http.StatusBadRequest, ErrBadPayload},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusNotFound, ErrBadRequest},
+		{http.StatusMethodNotAllowed, ErrBadRequest},
+		{http.StatusRequestEntityTooLarge, ErrBodyTooLarge},
+		{http.StatusRequestTimeout, errMustRetry},
+		{http.StatusTooManyRequests, errMustRetry},
+		{http.StatusInternalServerError, errMustRetry},
+		{http.StatusServiceUnavailable, errMustRetry},
+		{http.StatusTeapot, -1},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Status: fmt.Sprintf("%d %s", tt.status, http.StatusText(tt.status))}
+		err := statusError(resp)
+		switch {
+		case tt.code == 0:
+			if err != nil {
+				t.Errorf("statusError(%d) = %v; want nil", tt.status, err)
+			}
+		case tt.code == -1:
+			// Messages don't name any particular destination, since every exporter shares them.
+			if err == nil || strings.Contains(err.Error(), "NewRelic") || !strings.Contains(err.Error(), resp.Status) {
+				t.Errorf("statusError(%d) = %v; want an error with the status", tt.status, err)
+			}
+		case !iserr(err, tt.code):
+			t.Errorf("statusError(%d) = %v; want code %d", tt.status, err, tt.code)
+		}
+	}
+}
+
+func TestDestinationMergedDurations(t *testing.T) {
+	a := newTestAgent(t)
+	d := newDestination(a, "failing", failingExporter{errors.New("unreachable")}, time.Second)
+
+	// The first minute has metrics for app and db, and the second only for app.
+	t0 := payloadTime
+	snapshot := func(from, to time.Time, names ...string) *Body {
+		src := newTestAgent(t)
+		for _, name := range names {
+			src.body.Components = append(src.body.Components, &Component{
+				Name: name, GUID: "com.example." + name, start: from,
+				Metrics: Metrics{"Component/Requests[requests]": ScalarMetric(1)},
+			})
+		}
+		return src.snapshot(to)
+	}
+	d.send(snapshot(t0, t0.Add(time.Minute), "app", "db"), false)
+	d.enqueue(snapshot(t0.Add(time.Minute), t0.Add(2*time.Minute), "app"))
+
+	var buf bytes.Buffer
+	if _, err := a.getPayload(&buf, d.pending, NoCompression); err != nil {
+		t.Fatal(err)
+	}
+	var payload struct {
+		Components []struct {
+			Name     string `json:"name"`
+			Duration int    `json:"duration"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &payload); err != nil {
+		t.Fatalf("invalid payload %s: %v", buf.String(), err)
+	}
+
+	// Each component keeps the span its metrics were gathered over, so db isn't stretched to cover the second minute.
+	want := map[string]int{"app": 120, "db": 60}
+	got := make(map[string]int)
+	for _, com := range payload.Components {
+		got[com.Name] = com.Duration
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("durations = %v; want %v", got, want)
+	}
+}
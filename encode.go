@@ -0,0 +1,232 @@
+package skunk
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// payloadFlushSize is the size the encoder's buffer may grow to before it's written out.
+const payloadFlushSize = 32 * 1024
+
+// maxPooledBuffer is the largest buffer capacity kept by pooled encoders. Anything larger is released so one huge
+// payload doesn't pin its memory forever.
+const maxPooledBuffer = 1 << 20
+
+// payloadEncoder writes NewRelic plugin payloads as JSON directly from the components of a snapshot, without going
+// through reflection. Its output is byte-for-byte identical to encoding the snapshot with encoding/json, including key
+// order (map keys are sorted) and escaping. Invalid UTF-8 is written as the escape \ufffd, as encoding/json does
+// unless it's built on encoding/json/v2, which writes U+FFFD unescaped. Either decodes to the same string. Metrics of
+// types other than those in this package are encoded with encoding/json.
+//
+// Snapshots' metrics are already flattened and sanitized according to the agent's NonFinitePolicy (see
+// Agent.snapshot), so the encoder doesn't check them for non-finite values.
+//
+// Encoders are pooled, so use getPayloadEncoder and putPayloadEncoder rather than allocating them.
+type payloadEncoder struct {
+	buf  []byte
+	keys []string
+}
+
+var encoderPool = sync.Pool{
+	New: func() interface{} { return new(payloadEncoder) },
+}
+
+func getPayloadEncoder() *payloadEncoder {
+	return encoderPool.Get().(*payloadEncoder)
+}
+
+func putPayloadEncoder(e *payloadEncoder) {
+	if cap(e.buf) > maxPooledBuffer {
+		e.buf = nil
+	}
+	e.buf, e.keys = e.buf[:0], e.keys[:0]
+	encoderPool.Put(e)
+}
+
+// encode writes the payload for rep and components, which must be components of a snapshot, to w. Each component is
+// sent with its own Duration, as set by the snapshot or by merging it with later ones.
+func (e *payloadEncoder) encode(w io.Writer, rep AgentRep, components []*Component) error {
+	b := append(e.buf[:0], `{"agent":{"host":`...)
+	b = appendJSONString(b, rep.Host)
+	if rep.PID != 0 {
+		b = append(b, `,"pid":`...)
+		b = strconv.AppendInt(b, int64(rep.PID), 10)
+	}
+	b = append(b, `,"version":`...)
+	b = appendJSONString(b, rep.Version)
+	b = append(b, `},"components":[`...)
+
+	for i, com := range components {
+		if i > 0 {
+			b = append(b, ',')
+		}
+
+		b = append(b, `{"name":`...)
+		b = appendJSONString(b, com.Name)
+		b = append(b, `,"guid":`...)
+		b = appendJSONString(b, com.GUID)
+		b = append(b, `,"duration":`...)
+		b = strconv.AppendInt(b, roundSeconds(com.Duration.Duration), 10)
+		b = append(b, `,"metrics":{`...)
+
+		keys := e.keys[:0]
+		for key := range com.Metrics {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		e.keys = keys
+
+		for j, key := range keys {
+			if j > 0 {
+				b = append(b, ',')
+			}
+			b = appendJSONString(b, key)
+			b = append(b, ':')
+
+			var err error
+			if b, err = appendMetric(b, com.Metrics[key]); err != nil {
+				return err
+			}
+
+			if len(b) >= payloadFlushSize {
+				if _, err := w.Write(b); err != nil {
+					return err
+				}
+				b = b[:0]
+			}
+		}
+		b = append(b, "}}"...)
+	}
+	b = append(b, "]}\n"...)
+
+	e.buf = b
+	_, err := w.Write(b)
+	return err
+}
+
+// appendMetric appends the JSON encoding of m, which must be finite, to b.
+func appendMetric(b []byte, m Metric) ([]byte, error) {
+	switch m := m.(type) {
+	case ScalarMetric:
+		return appendJSONFloat(b, float64(m)), nil
+	case CounterMetric:
+		return appendJSONFloat(b, float64(m)), nil
+	case GaugeMetric:
+		return appendJSONFloat(b, float64(m)), nil
+	case RangeMetric:
+		return appendRange(b, m.Summary()), nil
+	case HistogramMetric:
+		return appendRange(b, m.Summary()), nil
+	}
+
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return b, err
+	}
+	return append(b, raw...), nil
+}
+
+// appendRange appends the JSON encoding of a RangeMetric described by s, which must be finite, to b.
+func appendRange(b []byte, s Summary) []byte {
+	b = append(b, `{"total":`...)
+	b = appendJSONFloat(b, s.Total)
+	b = append(b, `,"count":`...)
+	b = strconv.AppendInt(b, int64(s.Count), 10)
+	b = append(b, `,"min":`...)
+	b = appendJSONFloat(b, s.Min)
+	b = append(b, `,"max":`...)
+	b = appendJSONFloat(b, s.Max)
+	b = append(b, `,"sum_of_squares":`...)
+	b = appendJSONFloat(b, s.SumOfSquares)
+	return append(b, '}')
+}
+
+// roundSeconds returns d in seconds, rounded to the nearest second in the same way as Seconds.MarshalJSON.
+func roundSeconds(d time.Duration) int64 {
+	i, frac := math.Modf(d.Seconds())
+	if frac >= 0.5 {
+		return int64(i) + 1
+	}
+	return int64(i)
+}
+
+// appendJSONFloat appends f to b in the format used by encoding/json. f must be finite.
+func appendJSONFloat(b []byte, f float64) []byte {
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, f, format, -1, 64)
+	if format == 'e' {
+		// Clean up e-09 to e-9, as encoding/json does.
+		if n := len(b); n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s to b as a JSON string, escaped in the same way as encoding/json (including HTML
+// escaping). Invalid UTF-8 is replaced with an escaped U+FFFD.
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= ' ' && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\b':
+				b = append(b, '\\', 'b')
+			case '\f':
+				b = append(b, '\\', 'f')
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, `\ufffd`...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			// Valid JSON, but not valid JavaScript, so encoding/json escapes these too.
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
@@ -0,0 +1,276 @@
+package skunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files under testdata")
+
+// jsonEscapesInvalidUTF8 is whether encoding/json writes invalid UTF-8 as the escape \ufffd, as the payload encoder
+// does. When it's implemented on top of encoding/json/v2, it writes U+FFFD unescaped instead.
+var jsonEscapesInvalidUTF8 = func() bool {
+	b, _ := json.Marshal("\xff")
+	return string(b) == `"\ufffd"`
+}()
+
+// payloadTime is the time golden payloads are encoded as of.
+var payloadTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// payloadCases are the bodies encoded by TestPayloadGolden, as snapshots taken at payloadTime.
+var payloadCases = []struct {
+	name string
+	body *Body
+}{
+	{"empty-component-list", &Body{Agent: AgentRep{Host: "host", Version: "1.0"}}},
+	{"scalars", &Body{
+		Agent: AgentRep{Host: "host", PID: 1234, Version: "1.0"},
+		Components: []*Component{{
+			Name: "app", GUID: "com.example.app", start: payloadTime.Add(-time.Minute),
+			Metrics: Metrics{
+				"Component/Zero[things]":     ScalarMetric(0),
+				"Component/Negative[things]": ScalarMetric(-12.5),
+				"Component/NegZero[things]":  ScalarMetric(math.Copysign(0, -1)),
+				"Component/Counter[things]":  CounterMetric(42),
+				"Component/Gauge[things]":    GaugeMetric(0.1),
+			},
+		}},
+	}},
+	{"float-formats", &Body{
+		Agent: AgentRep{Host: "host", Version: "1.0"},
+		Components: []*Component{{
+			Name: "floats", GUID: "com.example.floats", start: payloadTime.Add(-1500 * time.Millisecond),
+			Metrics: Metrics{
+				"Component/Tiny[n]":         ScalarMetric(1e-7),
+				"Component/Small[n]":        ScalarMetric(1e-6),
+				"Component/Large[n]":        ScalarMetric(1e20),
+				"Component/Huge[n]":         ScalarMetric(1e21),
+				"Component/Max[n]":          ScalarMetric(math.MaxFloat64),
+				"Component/Smallest[n]":     ScalarMetric(math.SmallestNonzeroFloat64),
+				"Component/NegTiny[n]":      ScalarMetric(-3.5e-9),
+				"Component/Third[n]":        ScalarMetric(1.0 / 3),
+				"Component/Integral[n]":     ScalarMetric(123456789),
+				"Component/BigIntegral[n]":  ScalarMetric(1 << 60),
+				"Component/ExponentTen[n]":  ScalarMetric(1e-10),
+				"Component/ExponentNeg1[n]": ScalarMetric(-1e-100),
+			},
+		}},
+	}},
+	{"ranges", &Body{
+		Agent: AgentRep{Host: "host", Version: "1.0"},
+		Components: []*Component{{
+			Name: "ranges", GUID: "com.example.ranges", start: payloadTime.Add(-30 * time.Second),
+			Metrics: Metrics{
+				"Component/Range[ms]":     RangeMetric{}.Add(1).Add(2.5).Add(1e-7),
+				"Component/Histogram[ms]": NewHistogramMetric(1, 10).Add(0.5).Add(20),
+				"Component/Literal[ms]":   RangeMetric{Total: 3, Count: 2, Min: 1, Max: 2, Square: 5},
+			},
+		}},
+	}},
+	{"escaping", &Body{
+		Agent: AgentRep{Host: "<host> & \"friends\"", Version: "1.0\n\t\\"},
+		Components: []*Component{{
+			Name: "esc\u2028\u2029aped", GUID: "com.example/\x00\x01\x1f\x7f", start: payloadTime.Add(-time.Hour),
+			Metrics: Metrics{
+				"Component/Quote\"Backslash\\[n]":  ScalarMetric(1),
+				"Component/Html<b>&amp;</b>[n]":    ScalarMetric(2),
+				"Component/Controls\b\f\n\r\t[n]":  ScalarMetric(3),
+				"Component/Unicode/héllo/世界/🦨[n]":  ScalarMetric(4),
+				"Component/Invalid/\xff\xfe[n]":    ScalarMetric(5),
+				"Component/Truncated/\xe4\xb8[n]":  ScalarMetric(6),
+				"Component/Surrogate/\xed\xa0\x80": ScalarMetric(7),
+			},
+		}},
+	}},
+	{"several-components", &Body{
+		Agent: AgentRep{Host: "host", Version: "1.0"},
+		Components: []*Component{
+			{Name: "a", GUID: "com.example.a", start: payloadTime.Add(-time.Minute), Metrics: Metrics{"Component/X[n]": ScalarMetric(1)}},
+			// Components from the future are sent with zero duration.
+			{Name: "b", GUID: "com.example.b", start: payloadTime.Add(time.Minute), Metrics: Metrics{"Component/Y[n]": ScalarMetric(2)}},
+			{Name: "c", GUID: "com.example.c", start: payloadTime.Add(-499 * time.Millisecond), Metrics: Metrics{"Component/Z[n]": ScalarMetric(3)}},
+		},
+	}},
+}
+
+// snapshotOf returns a snapshot of body, as taken by an agent holding its components, at payloadTime.
+func snapshotOf(t testing.TB, body *Body) *Body {
+	a, err := NewWithRep("key", body.Agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.body.Components = body.Components
+	return a.snapshot(payloadTime)
+}
+
+func TestPayloadGolden(t *testing.T) {
+	for _, tt := range payloadCases {
+		t.Run(tt.name, func(t *testing.T) {
+			body := snapshotOf(t, tt.body)
+
+			enc := getPayloadEncoder()
+			defer putPayloadEncoder(enc)
+			var got bytes.Buffer
+			if err := enc.encode(&got, body.Agent, body.Components); err != nil {
+				t.Fatal(err)
+			}
+
+			// The payload must be identical to encoding/json's encoding of the same snapshot.
+			var want bytes.Buffer
+			if err := json.NewEncoder(&want).Encode(body); err != nil {
+				t.Fatal(err)
+			}
+			plain := got.Bytes()
+			if !jsonEscapesInvalidUTF8 {
+				// None of the cases hold a valid U+FFFD, so every escaped one replaced invalid UTF-8.
+				plain = bytes.Replace(plain, []byte(`\ufffd`), []byte("\ufffd"), -1)
+			}
+			if !bytes.Equal(plain, want.Bytes()) {
+				t.Errorf("payload differs from encoding/json:\ngot  %s\nwant %s", got.Bytes(), want.Bytes())
+			}
+
+			// And stay the same from one release to the next.
+			golden := filepath.Join("testdata", "payload", tt.name+".json")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, got.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), expected) {
+				t.Errorf("payload differs from %s:\ngot  %s\nwant %s", golden, got.Bytes(), expected)
+			}
+		})
+	}
+}
+
+func TestAppendJSONStringMatchesEncodingJSON(t *testing.T) {
+	// Every single byte, and every rune near the edges of the encodings, on its own and between other characters.
+	var inputs []string
+	for c := 0; c < 256; c++ {
+		inputs = append(inputs, string([]byte{byte(c)}), "a"+string([]byte{byte(c)})+"b")
+	}
+	for _, r := range []rune{0x7f, 0x80, 0x7ff, 0x800, 0xfffd, 0xffff, 0x10000, 0x10ffff, 0x2028, 0x2029} {
+		inputs = append(inputs, string(r), "x"+string(r)+"y")
+	}
+	inputs = append(inputs, "", "\xed\xa0\x80", "\xf4\x90\x80\x80", "\xc0\xaf", "\xe4\xb8", "ok\xffok\xfe")
+
+	for _, s := range inputs {
+		want, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := appendJSONString(nil, s)
+		if utf8.ValidString(s) || jsonEscapesInvalidUTF8 {
+			if !bytes.Equal(got, want) {
+				t.Errorf("appendJSONString(%q) = %s; want %s", s, got, want)
+			}
+			continue
+		}
+
+		// Invalid UTF-8 must still decode to the same string, with each bad byte escaped as \ufffd.
+		var gotString, wantString string
+		if err := json.Unmarshal(got, &gotString); err != nil {
+			t.Errorf("appendJSONString(%q) = %s: %v", s, got, err)
+		} else if json.Unmarshal(want, &wantString); gotString != wantString {
+			t.Errorf("appendJSONString(%q) decodes to %q; want %q", s, gotString, wantString)
+		} else if !bytes.Contains(got, []byte(`\ufffd`)) {
+			t.Errorf("appendJSONString(%q) = %s; want invalid UTF-8 escaped as \\ufffd", s, got)
+		}
+	}
+}
+
+func TestAppendJSONFloatMatchesEncodingJSON(t *testing.T) {
+	floats := []float64{0, math.Copysign(0, -1), 1, -1, 0.1, 1e-6, 1e-7, 9.999999e-7, 1e20, 1e21, 1e-10, 1e-100,
+		123456789.123, math.MaxFloat64, -math.MaxFloat64, math.SmallestNonzeroFloat64, 1 << 53, 5e-324}
+	for _, f := range floats {
+		want, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := appendJSONFloat(nil, f); !bytes.Equal(got, want) {
+			t.Errorf("appendJSONFloat(%v) = %s; want %s", f, got, want)
+		}
+	}
+}
+
+// benchmarkBody returns a snapshot with components components of metrics metrics each, half of them ranges.
+func benchmarkBody(b *testing.B, components, metrics int) *Body {
+	body := &Body{Agent: AgentRep{Host: "bench-host", PID: 1, Version: "1.0"}}
+	for i := 0; i < components; i++ {
+		com := &Component{
+			Name:    fmt.Sprintf("component-%d", i),
+			GUID:    fmt.Sprintf("com.example.component%d", i),
+			start:   payloadTime.Add(-time.Minute),
+			Metrics: make(Metrics, metrics),
+		}
+		for j := 0; j < metrics; j++ {
+			name := fmt.Sprintf("Component/Bench/Metric%d[ms]", j)
+			if j%2 == 0 {
+				com.Metrics[name] = ScalarMetric(float64(j) * 1.5)
+			} else {
+				com.Metrics[name] = RangeMetric{}.Add(float64(j)).Add(float64(j) / 3)
+			}
+		}
+		body.Components = append(body.Components, com)
+	}
+	return snapshotOf(b, body)
+}
+
+func BenchmarkPayloadEncoder(b *testing.B) {
+	body := benchmarkBody(b, 10, 100)
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		enc := getPayloadEncoder()
+		if err := enc.encode(&buf, body.Agent, body.Components); err != nil {
+			b.Fatal(err)
+		}
+		putPayloadEncoder(enc)
+	}
+	b.SetBytes(int64(buf.Len()))
+}
+
+func BenchmarkPayloadEncodingJSON(b *testing.B) {
+	body := benchmarkBody(b, 10, 100)
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(buf.Len()))
+}
+
+func BenchmarkGetPayload(b *testing.B) {
+	a, err := NewWithRep("key", AgentRep{Host: "bench-host", PID: 1, Version: "1.0"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	body := benchmarkBody(b, 10, 100)
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if _, err := a.getPayload(&buf, body, GzipCompression); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
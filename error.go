@@ -37,6 +37,28 @@ var errMessages = map[int]string{
 	ErrBadRequest:    "malformed request",
 	ErrBodyTooLarge:  "too many components and/or metrics in body",
 	ErrEncodingJSON:  "encountered an error in encoding a JSON payload",
+
+	// Collectors
+	ErrReadingProc:    "unable to read process statistics",
+	ErrMalformedProc:  "malformed process statistics",
+	ErrNoCgroup:       "no cgroup filesystem found",
+	ErrCollectorPanic: "collector panicked",
+
+	// SQL
+	ErrNamedValues: "driver does not support named values",
+	ErrTxOptions:   "driver does not support non-default transaction options",
+
+	// Events
+	ErrNoEventAccount:    "no account ID set for events",
+	ErrBadEventType:      "event type must be 1 to 255 letters, digits, underscores, or colons",
+	ErrBadEventAttribute: "invalid event attribute",
+
+	// StatsD
+	ErrMalformedStatsD: "malformed StatsD line",
+
+	// Accounts
+	ErrUnknownAccount: "no such account",
+
 	// Private
 	errNoMetrics:    "nothing to send",
 	errMustRetry:    "must retry this request",
@@ -75,6 +97,32 @@ const (
 	ErrBodyTooLarge
 	ErrEncodingJSON
 
+	// Collector errors
+
+	ErrReadingProc
+	ErrMalformedProc
+	ErrNoCgroup
+	ErrCollectorPanic
+
+	// SQL driver errors
+
+	ErrNamedValues
+	ErrTxOptions
+
+	// Event errors
+
+	ErrNoEventAccount
+	ErrBadEventType
+	ErrBadEventAttribute
+
+	// StatsD errors
+
+	ErrMalformedStatsD
+
+	// Account errors
+
+	ErrUnknownAccount
+
 	// Private errors
 
 	// errNoMetrics is returned by getPayload when there are no metrics to send. This is a non-fatal error that just
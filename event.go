@@ -0,0 +1,345 @@
+package skunk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// EventAPI is the URL format of NewRelic's Event API. The account ID is substituted for %s. This may be altered to
+// change the endpoint events are sent to (e.g., to https://insights-collector.eu01.nr-data.net/v1/accounts/%s/events
+// for EU accounts). Already-initialized agents do not use this.
+var EventAPI = `https://insights-collector.newrelic.com/v1/accounts/%s/events`
+
+// Limits imposed on events by NewRelic's Event API.
+const (
+	MaxEventAttributes     = 255  // Maximum number of attributes per event, including eventType and timestamp
+	MaxEventAttributeName  = 255  // Maximum length, in bytes, of event types and attribute names
+	MaxEventAttributeValue = 4096 // Maximum length, in bytes, of string attribute values
+)
+
+// DefaultMaxEvents is the default number of unsent events an agent holds onto before dropping the oldest.
+const DefaultMaxEvents = 10000
+
+// eventBatchSize is the maximum number of events sent per request, which keeps requests well under the Event API's
+// 1MB limit.
+const eventBatchSize = 1000
+
+// event is a single event, as sent to the Event API.
+type event map[string]interface{}
+
+// RecordEvent records an event of the given type with the given attributes. Events are held by the agent and sent to
+// NewRelic's Event API each time the agent sends its metrics. Events are kept and retried after a delay if the Event
+// API is unavailable, independently of metrics. The agent's EventAccountID must be set.
+//
+// Attribute values may be strings, bools, integers, finite floats, or time.Times (sent as Unix time in milliseconds).
+// The eventType attribute is set from eventType, and the timestamp attribute is set to the current time unless given.
+// If the event type, any attribute, or the number of attributes is invalid, the event isn't recorded and an error is
+// returned.
+func (a *Agent) RecordEvent(eventType string, attrs map[string]interface{}) error {
+	if a.EventAccountID == "" {
+		return mkerr(ErrNoEventAccount, nil)
+	}
+
+	ev, err := newEvent(eventType, attrs, time.Now())
+	if err != nil {
+		return err
+	}
+
+	a.ops <- func(a *Agent) error {
+		limit := a.MaxEvents
+		if limit <= 0 {
+			limit = DefaultMaxEvents
+		}
+		if len(a.events) >= limit {
+			// Drop the oldest events to make room.
+			drop := len(a.events) - limit + 1
+			a.droppedEvents += drop
+			a.events = a.events[drop:]
+		}
+		a.events = append(a.events, ev)
+		return nil
+	}
+	return nil
+}
+
+// newEvent validates eventType and attrs and returns a copy of attrs with the eventType and timestamp attributes set.
+func newEvent(eventType string, attrs map[string]interface{}, now time.Time) (event, error) {
+	if !validEventType(eventType) {
+		return nil, mkerr(ErrBadEventType, fmt.Errorf("%q", eventType))
+	}
+
+	ev := make(event, len(attrs)+2)
+	for name, value := range attrs {
+		if name == "" || len(name) > MaxEventAttributeName || name == "eventType" {
+			return nil, mkerr(ErrBadEventAttribute, fmt.Errorf("invalid attribute name %q", name))
+		}
+
+		v, err := eventValue(value)
+		if err != nil {
+			return nil, mkerr(ErrBadEventAttribute, fmt.Errorf("attribute %s: %v", name, err))
+		}
+		ev[name] = v
+	}
+
+	ev["eventType"] = eventType
+	if _, ok := ev["timestamp"]; !ok {
+		ev["timestamp"] = now.UnixNano() / int64(time.Millisecond)
+	}
+	if len(ev) > MaxEventAttributes {
+		return nil, mkerr(ErrBadEventAttribute, fmt.Errorf("%d attributes, no more than %d allowed", len(ev), MaxEventAttributes))
+	}
+	return ev, nil
+}
+
+func validEventType(eventType string) bool {
+	if eventType == "" || len(eventType) > MaxEventAttributeName {
+		return false
+	}
+	for _, r := range eventType {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// eventValue returns the value of an event attribute as it's sent to the Event API, or an error if it's not a valid
+// attribute value.
+func eventValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		if len(v) > MaxEventAttributeValue {
+			return nil, fmt.Errorf("string longer than %d bytes", MaxEventAttributeValue)
+		} else if !utf8.ValidString(v) {
+			return nil, fmt.Errorf("string is not valid UTF-8")
+		}
+		return v, nil
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return v, nil
+	case float32:
+		return eventValue(float64(v))
+	case float64:
+		if !isFinite(v) {
+			return nil, fmt.Errorf("non-finite value %v", v)
+		}
+		return v, nil
+	case time.Time:
+		return v.UnixNano() / int64(time.Millisecond), nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", value)
+}
+
+// eventSender sends an agent's events to the Event API from its own goroutine, so a slow or unreachable Event API
+// doesn't hold up the runloop. Like a destination, it keeps the events it failed to send because the Event API is
+// unavailable or unreachable, along with any recorded since, and retries them after retryDelay. Events the Event API
+// rejects are dropped.
+type eventSender struct {
+	agent *Agent
+	url   string
+	limit int
+
+	// signal is sent on, without blocking, when there are events to send or the sender is closing.
+	signal chan struct{}
+	// done is closed once the sender's goroutine has made its final send and exited.
+	done chan struct{}
+
+	mu        sync.Mutex
+	pending   []event
+	dropped   int
+	closing   bool
+	retrying  bool
+	nextRetry time.Time
+}
+
+func newEventSender(a *Agent) *eventSender {
+	limit := a.MaxEvents
+	if limit <= 0 {
+		limit = DefaultMaxEvents
+	}
+	return &eventSender{
+		agent:  a,
+		url:    fmt.Sprintf(a.eventURL, a.EventAccountID),
+		limit:  limit,
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// enqueue adds events, and the number of events dropped before they were handed over, to those waiting to be sent.
+// If that exceeds the sender's limit, the oldest are dropped. events must not be modified afterward.
+func (s *eventSender) enqueue(events []event, dropped int) {
+	s.mu.Lock()
+	s.pending = append(s.pending, events...)
+	s.dropped += dropped
+	if over := len(s.pending) - s.limit; over > 0 {
+		s.dropped += over
+		s.pending = append([]event(nil), s.pending[over:]...)
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// close tells the sender to make a final attempt at sending its pending events and stop.
+func (s *eventSender) close() {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *eventSender) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// unsent returns the number of events waiting to be sent.
+func (s *eventSender) unsent() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+// run sends events as they're enqueued, until the sender is closed.
+func (s *eventSender) run() {
+	defer close(s.done)
+
+	timer := time.NewTimer(retryDelay)
+	timer.Stop()
+	for {
+		select {
+		case <-s.signal:
+		case <-timer.C:
+		}
+
+		s.mu.Lock()
+		if s.retrying && time.Now().Before(s.nextRetry) && !s.closing {
+			// Hold onto new events until it's time to retry.
+			s.mu.Unlock()
+			continue
+		}
+		events, dropped, closing := s.pending, s.dropped, s.closing
+		s.pending, s.dropped = nil, 0
+		s.mu.Unlock()
+
+		if dropped > 0 {
+			s.agent.Logger.Warn("skunk: dropped oldest events over limit", "events", dropped)
+		}
+		if len(events) > 0 && s.send(events, closing) {
+			timer.Reset(retryDelay)
+		}
+		if closing {
+			return
+		}
+	}
+}
+
+// send sends events to the Event API in batches and handles any error. Events are done with once the batch they're in
+// is accepted, so if a batch fails, only the events not yet accepted are kept. If final is set, events are dropped
+// rather than kept for a retry. It returns true if the send must be retried.
+func (s *eventSender) send(events []event, final bool) (retry bool) {
+	a := s.agent
+	var err error
+	for len(events) > 0 {
+		n := len(events)
+		if n > eventBatchSize {
+			n = eventBatchSize
+		}
+
+		ctx, cancel := context.WithTimeout(WithoutMetrics(context.Background()), DefaultExportTimeout)
+		err = s.post(ctx, events[:n])
+		cancel()
+		if err != nil {
+			break
+		}
+		events = events[n:]
+	}
+	if err == nil {
+		return false
+	}
+
+	a.recordError(err)
+	if _, ok := err.(*Error); !ok || iserr(err, errMustRetry) {
+		if final {
+			a.Logger.Warn("skunk: NewRelic Event API is unavailable on shutdown flush - dropping events on the floor",
+				"events", len(events), "error", err)
+			return false
+		}
+
+		// NewRelic is unavailable or unreachable, so try again later.
+		s.mu.Lock()
+		s.pending = append(events, s.pending...)
+		if over := len(s.pending) - s.limit; over > 0 {
+			s.dropped += over
+			s.pending = s.pending[over:]
+		}
+		s.retrying, s.nextRetry = true, time.Now().Add(retryDelay)
+		s.mu.Unlock()
+		a.Logger.Warn("skunk: NewRelic Event API is unavailable, keeping events",
+			"events", len(events), "retry_delay", retryDelay, "error", err)
+		return true
+	}
+
+	s.mu.Lock()
+	s.retrying = false
+	s.mu.Unlock()
+	a.Logger.Error("skunk: received error on sending events to NewRelic", "error", err, "dropped", len(events))
+	return false
+}
+
+func (s *eventSender) post(ctx context.Context, events []event) error {
+	a := s.agent
+	var buf bytes.Buffer
+	err := compress(&buf, GzipCompression, a.CompressionLevel, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(events)
+	})
+	if err != nil {
+		return mkerr(ErrEncodingJSON, err)
+	}
+
+	req, err := http.NewRequest("POST", s.url, &buf)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	key := a.EventAPIKey
+	if key == "" {
+		key = a.apiKey
+	}
+	req.Header.Set("Api-Key", key)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode == 200 {
+		a.Logger.Debug("skunk: sent events to NewRelic", "events", len(events), "bytes", buf.Len())
+	}
+	return statusError(resp)
+}
+
+// flushEvents hands the agent's unsent events, if any, to its event sender. This must only be called from the runloop.
+func (a *Agent) flushEvents() {
+	if len(a.events) == 0 && a.droppedEvents == 0 {
+		return
+	}
+	a.eventSender.enqueue(a.events, a.droppedEvents)
+	a.events, a.droppedEvents = nil, 0
+}
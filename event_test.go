@@ -0,0 +1,155 @@
+package skunk
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventServer is a stand-in for the Event API that records the events it receives and responds with status.
+type eventServer struct {
+	*httptest.Server
+	status   int
+	delay    chan struct{} // If non-nil, requests wait for it to be closed.
+	received chan []map[string]interface{}
+
+	mu       sync.Mutex
+	requests int
+}
+
+func newEventServer(t *testing.T, status int) *eventServer {
+	s := &eventServer{status: status, received: make(chan []map[string]interface{}, 100)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		s.mu.Unlock()
+		if s.delay != nil {
+			<-s.delay
+		}
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("invalid gzip body: %v", err)
+			return
+		}
+		var events []map[string]interface{}
+		if err := json.NewDecoder(zr).Decode(&events); err != nil {
+			t.Errorf("invalid JSON body: %v", err)
+		}
+		w.WriteHeader(s.status)
+		if s.status == 200 {
+			s.received <- events
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *eventServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func newEventAgent(t *testing.T, s *eventServer) *Agent {
+	a := newTestAgent(t)
+	a.Cycle = 50 * time.Millisecond
+	a.EventAccountID = "1234"
+	a.eventURL = s.URL + "/v1/accounts/%s/events"
+	return a
+}
+
+func TestRecordEventSends(t *testing.T) {
+	s := newEventServer(t, 200)
+	a := newEventAgent(t, s)
+	a.Start()
+	defer a.Close()
+
+	if err := a.RecordEvent("Deploy", map[string]interface{}{"version": "1.2.3", "ok": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case events := <-s.received:
+		if len(events) != 1 || events[0]["eventType"] != "Deploy" || events[0]["version"] != "1.2.3" {
+			t.Errorf("received %v", events)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for events")
+	}
+}
+
+func TestSlowEventAPIDoesNotBlockAgent(t *testing.T) {
+	s := newEventServer(t, 200)
+	s.delay = make(chan struct{})
+	a := newEventAgent(t, s)
+	a.Start()
+
+	if err := a.RecordEvent("Deploy", nil); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.count() == 0 {
+		t.Fatal("timed out waiting for request")
+	}
+
+	// The Event API hasn't responded, but the runloop must still be free.
+	done := make(chan struct{})
+	go func() {
+		a.Status()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Status blocked while sending events")
+	}
+
+	close(s.delay)
+	a.Close()
+}
+
+func TestUnavailableEventAPIKeepsEvents(t *testing.T) {
+	s := newEventServer(t, 503)
+	a := newEventAgent(t, s)
+	a.Start()
+	defer a.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := a.RecordEvent("Job", map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The failed send is retried after retryDelay, so the events stay pending without further requests until then.
+	deadline := time.Now().Add(5 * time.Second)
+	for s.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(4 * a.Cycle)
+	if st := a.Status(); st.UnsentEvents != 3 {
+		t.Errorf("UnsentEvents = %d; want 3", st.UnsentEvents)
+	}
+	if n := s.count(); n != 1 {
+		t.Errorf("Event API requests = %d; want 1 before the retry delay", n)
+	}
+}
+
+func TestEventSenderLimit(t *testing.T) {
+	a := newTestAgent(t)
+	a.MaxEvents = 2
+	s := newEventSender(a)
+
+	s.enqueue([]event{{"n": 1}, {"n": 2}}, 0)
+	s.enqueue([]event{{"n": 3}}, 1)
+	if s.dropped != 2 || len(s.pending) != 2 || s.pending[0]["n"] != 2 || s.pending[1]["n"] != 3 {
+		t.Errorf("pending = %v, dropped = %d; want [2 3], 2", s.pending, s.dropped)
+	}
+}
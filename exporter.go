@@ -0,0 +1,40 @@
+package skunk
+
+import (
+	"context"
+	"strings"
+)
+
+// Exporter sends an agent's metrics somewhere other than NewRelic's plugin API. An agent passes each of its Exporters
+// a snapshot of its metrics each cycle (see Agent.Exporters).
+//
+// The Body passed to Export holds only components with metrics, with their metrics already sanitized under the
+// agent's NonFinite policy, and component durations running up to the time the metrics were gathered. The same Body is
+// passed to every exporter, so it must not be modified. If an earlier send failed because the exporter was unavailable
+// or unreachable (Export returned an error that isn't an *Error), the Body holds those metrics too, merged with the
+// metrics gathered since.
+//
+// Export is called from a goroutine of the exporter's own, one call at a time, and the agent waits on it when it's
+// closed, so it must not record metrics to the agent that called it. It should return once the context it's given is
+// done, and any HTTP requests it makes should use that context, which is marked with WithoutMetrics.
+type Exporter interface {
+	Export(ctx context.Context, body *Body) error
+}
+
+// ExporterFunc is a function that implements Exporter.
+type ExporterFunc func(ctx context.Context, body *Body) error
+
+func (fn ExporterFunc) Export(ctx context.Context, body *Body) error {
+	return fn(ctx, body)
+}
+
+// splitUnit splits a metric name of the form Category/Name[unit] into its name and unit. If the name has no unit, unit
+// is empty.
+func splitUnit(name string) (base, unit string) {
+	if strings.HasSuffix(name, "]") {
+		if i := strings.LastIndexByte(name, '['); i != -1 {
+			return name[:i], name[i+1 : len(name)-1]
+		}
+	}
+	return name, ""
+}
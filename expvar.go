@@ -0,0 +1,184 @@
+package skunk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExpvarCollector is a Collector that records numeric expvar variables. Each number found is recorded as
+// Component/Expvar/<name>[value], where name is the variable's name. Maps (expvar.Map and JSON objects, such as
+// memstats) are walked, with each key appended to the name -- e.g., memstats' HeapAlloc field is recorded as
+// Component/Expvar/memstats/HeapAlloc[value]. Booleans are recorded as 0 or 1. Strings and arrays are skipped, as are
+// agent snapshots published with PublishExpvar or ExpvarSnapshot, which hold metrics already recorded by an agent.
+type ExpvarCollector struct {
+	// Vars is the list of top-level variables to record. If empty, all published variables are recorded.
+	Vars []string
+}
+
+// NewExpvarCollector returns an ExpvarCollector for the named variables. If no names are given, all published variables
+// are recorded.
+func NewExpvarCollector(vars ...string) *ExpvarCollector {
+	return &ExpvarCollector{Vars: vars}
+}
+
+func (c *ExpvarCollector) Collect(ctx context.Context) (Metrics, error) {
+	metrics := make(Metrics)
+	if len(c.Vars) == 0 {
+		expvar.Do(func(kv expvar.KeyValue) {
+			addExpvar(metrics, "Component/Expvar/"+expvarName(kv.Key), kv.Value)
+		})
+		return metrics, nil
+	}
+
+	for _, name := range c.Vars {
+		if v := expvar.Get(name); v != nil {
+			addExpvar(metrics, "Component/Expvar/"+expvarName(name), v)
+		}
+	}
+	return metrics, nil
+}
+
+// addExpvar records the numbers held by v under prefix. Well-known expvar types are read directly; anything else is
+// decoded from its JSON representation.
+func addExpvar(metrics Metrics, prefix string, v expvar.Var) {
+	switch v := v.(type) {
+	case *expvarSnapshot:
+		return
+	case *expvar.Int:
+		metrics.AddFloat(prefix+"[value]", float64(v.Value()))
+	case *expvar.Float:
+		metrics.AddFloat(prefix+"[value]", v.Value())
+	case *expvar.Map:
+		v.Do(func(kv expvar.KeyValue) {
+			addExpvar(metrics, prefix+"/"+expvarName(kv.Key), kv.Value)
+		})
+	case expvar.Func:
+		addExpvarValue(metrics, prefix, v.Value())
+	default:
+		addExpvarJSON(metrics, prefix, []byte(v.String()))
+	}
+}
+
+// addExpvarJSON decodes b as JSON and records the numbers it holds under prefix.
+func addExpvarJSON(metrics Metrics, prefix string, b []byte) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var val interface{}
+	if dec.Decode(&val) == nil {
+		addExpvarValue(metrics, prefix, val)
+	}
+}
+
+// addExpvarValue records the numbers held by a decoded JSON value, or the value returned by an expvar.Func, under prefix.
+func addExpvarValue(metrics Metrics, prefix string, val interface{}) {
+	var f float64
+	switch val := val.(type) {
+	case json.Number:
+		n, err := val.Float64()
+		if err != nil {
+			return
+		}
+		f = n
+	case float64:
+		f = val
+	case float32:
+		f = float64(val)
+	case int:
+		f = float64(val)
+	case int64:
+		f = float64(val)
+	case int32:
+		f = float64(val)
+	case uint:
+		f = float64(val)
+	case uint64:
+		f = float64(val)
+	case uint32:
+		f = float64(val)
+	case bool:
+		if val {
+			f = 1
+		}
+	case map[string]interface{}:
+		for k, v := range val {
+			addExpvarValue(metrics, prefix+"/"+expvarName(k), v)
+		}
+		return
+	case expvar.Var:
+		addExpvar(metrics, prefix, val)
+		return
+	case string, []interface{}, nil:
+		return
+	default:
+		// Some other type, such as the struct returned by memstats. Go through JSON to find its numbers.
+		if b, err := json.Marshal(val); err == nil {
+			addExpvarJSON(metrics, prefix, b)
+		}
+		return
+	}
+	metrics.AddFloat(prefix+"[value]", f)
+}
+
+// expvarName makes an expvar name or map key safe for use as a segment of a metric name.
+func expvarName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '[', ']':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// ExpvarSnapshot returns an expvar.Var whose value is the agent's current Snapshot. Until the agent is started, its
+// value is null. Once the agent starts shutting down, its value is the last snapshot read.
+func ExpvarSnapshot(a *Agent) expvar.Var {
+	return &expvarSnapshot{agent: a}
+}
+
+// expvarSnapshot is the expvar.Var returned by ExpvarSnapshot.
+type expvarSnapshot struct {
+	agent *Agent
+
+	mu   sync.Mutex
+	last *Body
+}
+
+func (v *expvarSnapshot) String() string {
+	b, err := json.Marshal(v.value())
+	if err != nil {
+		return "null"
+	}
+	return string(b)
+}
+
+// value returns the agent's current snapshot if it's running, and the last snapshot read otherwise.
+func (v *expvarSnapshot) value() *Body {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if body, ok := v.agent.trySnapshot(); ok {
+		v.last = body
+	}
+	return v.last
+}
+
+// trySnapshot returns the agent's Snapshot if it's running. Unlike Snapshot, it neither blocks forever if the agent
+// hasn't been started nor panics if it's been closed.
+func (a *Agent) trySnapshot() (*Body, bool) {
+	out := make(chan *Body, 1)
+	if !a.tryOp(func(a *Agent) error { out <- a.snapshot(time.Now()); return nil }) {
+		return nil, false
+	}
+	return <-out, true
+}
+
+// PublishExpvar publishes the agent's current Snapshot as an expvar variable with the given name, making it visible
+// under /debug/vars. Like expvar.Publish, it panics if the name is already in use.
+func (a *Agent) PublishExpvar(name string) {
+	expvar.Publish(name, ExpvarSnapshot(a))
+}
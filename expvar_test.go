@@ -0,0 +1,101 @@
+package skunk
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// expvarRuns numbers the runs of tests publishing expvars, which can only be published once per name, so that each
+// run with -count publishes its own.
+var expvarRuns int32
+
+func TestExpvarCollectorSkipsSnapshots(t *testing.T) {
+	a := newTestAgent(t)
+	a.Start()
+	defer a.Close()
+	com, err := a.Component("app", "com.example.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	com.AddMetric("Component/Recorded[things]", 1)
+
+	run := strconv.Itoa(int(atomic.AddInt32(&expvarRuns, 1)))
+	snapshot, count := "skunktest.snapshot"+run, "skunktest.count"+run
+	a.PublishExpvar(snapshot)
+	expvar.NewInt(count).Set(3)
+
+	metrics, err := (&ExpvarCollector{}).Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := metrics["Component/Expvar/"+count+"[value]"]; !ok || m != ScalarMetric(3) {
+		t.Errorf("%s = %v; want 3", count, m)
+	}
+	for name := range metrics {
+		if strings.HasPrefix(name, "Component/Expvar/skunktest.snapshot") {
+			t.Errorf("recorded agent snapshot as %s", name)
+		}
+	}
+
+	metrics, _ = NewExpvarCollector(snapshot).Collect(context.Background())
+	if len(metrics) != 0 {
+		t.Errorf("recorded agent snapshot when named: %v", metrics)
+	}
+}
+
+func TestExpvarSnapshotLifecycle(t *testing.T) {
+	a := newTestAgent(t)
+	v := ExpvarSnapshot(a)
+
+	// Reading the snapshot before the agent starts mustn't block.
+	if s := v.String(); s != "null" {
+		t.Errorf("snapshot before Start = %s; want null", s)
+	}
+
+	a.Start()
+	com, err := a.Component("app", "com.example.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	com.AddMetric("Component/Recorded[things]", 1)
+
+	var body struct {
+		Components []struct {
+			Name string `json:"name"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal([]byte(v.String()), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Components) != 1 || body.Components[0].Name != "app" {
+		t.Errorf("snapshot while running = %+v; want the app component", body)
+	}
+	running := v.String()
+
+	// Once closed, the last snapshot read is kept instead of panicking.
+	a.Close()
+	if s := v.String(); s != running {
+		t.Errorf("snapshot after Close = %s; want %s", s, running)
+	}
+}
+
+func TestExpvarSnapshotDuringStart(t *testing.T) {
+	// Polling the snapshot while the agent starts and closes mustn't race with either.
+	a := newTestAgent(t)
+	v := ExpvarSnapshot(a)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = v.String()
+		}
+	}()
+	a.Start()
+	a.Close()
+	<-done
+}
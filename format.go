@@ -0,0 +1,175 @@
+package skunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// MetricFormatter writes the metrics of a set of components in some human- or machine-readable format. It's used to
+// write an agent's metrics to its Log each cycle when LogMetrics is set.
+//
+// Metrics are described using their Summary. Metrics that can't be summarized (see Summarizer) are written as their
+// JSON encoding instead.
+type MetricFormatter interface {
+	FormatMetrics(w io.Writer, components []*Component) error
+}
+
+// MetricFormatterFunc is a function that implements MetricFormatter.
+type MetricFormatterFunc func(w io.Writer, components []*Component) error
+
+func (fn MetricFormatterFunc) FormatMetrics(w io.Writer, components []*Component) error {
+	return fn(w, components)
+}
+
+var (
+	// TableFormat writes an aligned table of metrics for each component. This is the default format.
+	TableFormat MetricFormatter = MetricFormatterFunc(formatTable)
+	// JSONLinesFormat writes one JSON object per metric, each on its own line.
+	JSONLinesFormat MetricFormatter = MetricFormatterFunc(formatJSONLines)
+	// LogfmtFormat writes one logfmt line (key=value pairs) per metric.
+	LogfmtFormat MetricFormatter = MetricFormatterFunc(formatLogfmt)
+)
+
+// sortedMetricNames returns the names of the component's metrics, sorted so the output is easier to sift through.
+func sortedMetricNames(com *Component) []string {
+	keys := make([]string, 0, len(com.Metrics))
+	for key := range com.Metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricJSON returns the JSON encoding of a metric that can't be summarized.
+func metricJSON(m Metric) string {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "!(" + err.Error() + ")"
+	}
+	return string(b)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func formatTable(w io.Writer, components []*Component) error {
+	tw := tabwriter.NewWriter(w, 1, 8, 1, ' ', tabwriter.TabIndent)
+	for _, com := range components {
+		if len(com.Metrics) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(tw, "%s (%s) %v\n\tName\tCount\tTotal\tAverage\tMin\tMax\tSS\n", com.Name, com.GUID, com.Duration.Duration)
+		for _, key := range sortedMetricNames(com) {
+			s, ok := summarize(com.Metrics[key])
+			if !ok {
+				fmt.Fprintf(tw, "\t%s\t-\t%s\t-\t-\t-\t-\n", key, metricJSON(com.Metrics[key]))
+				continue
+			}
+			fmt.Fprintf(tw, "\t%s\t%d\t%v\t%v\t%v\t%v\t%v\n",
+				key, s.Count, s.Total, s.Mean(), s.Min, s.Max, s.Variance()*float64(s.Count))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricLine is a single metric as written by JSONLinesFormat.
+type metricLine struct {
+	Component    string          `json:"component"`
+	GUID         string          `json:"guid"`
+	Duration     float64         `json:"duration"`
+	Name         string          `json:"name"`
+	Count        *int            `json:"count,omitempty"`
+	Total        *float64        `json:"total,omitempty"`
+	Mean         *float64        `json:"mean,omitempty"`
+	Min          *float64        `json:"min,omitempty"`
+	Max          *float64        `json:"max,omitempty"`
+	StdDev       *float64        `json:"stddev,omitempty"`
+	SumOfSquares *float64        `json:"sum_of_squares,omitempty"`
+	Value        json.RawMessage `json:"value,omitempty"`
+}
+
+func formatJSONLines(w io.Writer, components []*Component) error {
+	enc := json.NewEncoder(w)
+	for _, com := range components {
+		for _, key := range sortedMetricNames(com) {
+			line := metricLine{
+				Component: com.Name,
+				GUID:      com.GUID,
+				Duration:  com.Duration.Seconds(),
+				Name:      key,
+			}
+
+			if s, ok := summarize(com.Metrics[key]); ok {
+				mean, stddev := s.Mean(), s.StdDev()
+				line.Count, line.Total, line.Mean, line.Min, line.Max, line.StdDev, line.SumOfSquares =
+					&s.Count, &s.Total, &mean, &s.Min, &s.Max, &stddev, &s.SumOfSquares
+			} else {
+				line.Value = json.RawMessage(metricJSON(com.Metrics[key]))
+			}
+
+			if err := enc.Encode(line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatLogfmt(w io.Writer, components []*Component) error {
+	var buf bytes.Buffer
+	for _, com := range components {
+		for _, key := range sortedMetricNames(com) {
+			buf.Reset()
+			writeLogfmt(&buf, "component", com.Name)
+			writeLogfmt(&buf, "guid", com.GUID)
+			writeLogfmt(&buf, "duration", com.Duration.Duration.String())
+			writeLogfmt(&buf, "name", key)
+
+			if s, ok := summarize(com.Metrics[key]); ok {
+				writeLogfmt(&buf, "count", strconv.Itoa(s.Count))
+				writeLogfmt(&buf, "total", formatFloat(s.Total))
+				writeLogfmt(&buf, "mean", formatFloat(s.Mean()))
+				writeLogfmt(&buf, "min", formatFloat(s.Min))
+				writeLogfmt(&buf, "max", formatFloat(s.Max))
+				writeLogfmt(&buf, "stddev", formatFloat(s.StdDev()))
+				writeLogfmt(&buf, "sum_of_squares", formatFloat(s.SumOfSquares))
+			} else {
+				writeLogfmt(&buf, "value", metricJSON(com.Metrics[key]))
+			}
+
+			buf.WriteByte('\n')
+			if _, err := buf.WriteTo(w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeLogfmt appends a logfmt key=value pair to buf. Values containing spaces, quotes, equals signs, or control
+// characters are quoted.
+func writeLogfmt(buf *bytes.Buffer, key, value string) {
+	if buf.Len() > 0 {
+		buf.WriteByte(' ')
+	}
+	buf.WriteString(key)
+	buf.WriteByte('=')
+	if value == "" || strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == 0x7f
+	}) != -1 {
+		buf.WriteString(strconv.Quote(value))
+	} else {
+		buf.WriteString(value)
+	}
+}
@@ -0,0 +1,195 @@
+package skunk
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultGraphiteTimeout is the default time a GraphiteExporter is given to connect and write its metrics.
+const DefaultGraphiteTimeout = 10 * time.Second
+
+// GraphiteExporter is an Exporter that sends metrics to a Graphite server (i.e., carbon) in its plaintext protocol,
+// as lines of the form path value timestamp over TCP. Each metric is sent with the time its component's metrics were
+// gathered up to. CounterMetrics, GaugeMetrics, and ScalarMetrics are sent as a single value. Graphite has no way to
+// hold a range of values, so RangeMetrics, and any other kind of metric, are sent as five paths under the metric's
+// path: count, sum, min, max, and mean.
+//
+// Paths are built from the metric's name with any leading Component/ segment removed, slashes replaced by dots, and
+// its unit appended to the last segment with an underscore, prefixed by the component's name. For example,
+// Component/HTTP/index/ResponseTime[ms] in the web component is sent as web.HTTP.index.ResponseTime_ms, and
+// Component/CPU/Usage[%] as web.CPU.Usage_percent. Any character other than ASCII letters, digits, underscores, and
+// hyphens is replaced by an underscore within segments.
+//
+// If Tagged is set, the component's name isn't part of paths. Instead, metrics are sent as Graphite tagged series,
+// with the component's name as the component tag, along with the component's attributes and those of each metric,
+// which aren't flattened into the metric's path. Tags with empty values are left out, since Graphite doesn't allow
+// them.
+type GraphiteExporter struct {
+	// Addr is the address of the Graphite server's plaintext listener, such as 127.0.0.1:2003.
+	Addr string
+	// Prefix, if set, is prepended to every path, followed by a dot.
+	Prefix string
+	// Tagged enables Graphite tags for components and attributes.
+	Tagged bool
+	// Timeout is the time allowed to connect to the server and write metrics. If zero or less, DefaultGraphiteTimeout
+	// is used.
+	Timeout time.Duration
+}
+
+// NewGraphiteExporter returns a GraphiteExporter sending to the Graphite server at addr.
+func NewGraphiteExporter(addr string) *GraphiteExporter {
+	return &GraphiteExporter{Addr: addr}
+}
+
+func (e *GraphiteExporter) Export(ctx context.Context, body *Body) error {
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = DefaultGraphiteTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", e.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	for _, com := range body.Components {
+		ts := " " + strconv.FormatInt(com.start.Add(com.Duration.Duration).Unix(), 10) + "\n"
+
+		if e.Tagged {
+			for _, s := range com.Series() {
+				writeGraphite(w, e.path("", s.Name), graphiteTags(com, s.Attributes), s.Metric, ts)
+			}
+			continue
+		}
+
+		for _, key := range sortedMetricNames(com) {
+			writeGraphite(w, e.path(com.Name, key), "", com.Metrics[key], ts)
+		}
+	}
+	return w.Flush()
+}
+
+// writeGraphite writes the lines of a single metric. Write errors are left to the writer's Flush.
+func writeGraphite(w *bufio.Writer, path, tags string, m Metric, ts string) {
+	line := func(path, value string) {
+		w.WriteString(path)
+		w.WriteString(tags)
+		w.WriteByte(' ')
+		w.WriteString(value)
+		w.WriteString(ts)
+	}
+
+	switch m := m.(type) {
+	case CounterMetric:
+		line(path, formatFloat(float64(m)))
+		return
+	case GaugeMetric:
+		line(path, formatFloat(float64(m)))
+		return
+	case ScalarMetric:
+		line(path, formatFloat(float64(m)))
+		return
+	}
+
+	s, _ := summarize(m)
+	line(path+".count", strconv.Itoa(s.Count))
+	line(path+".sum", formatFloat(s.Total))
+	line(path+".min", formatFloat(s.Min))
+	line(path+".max", formatFloat(s.Max))
+	line(path+".mean", formatFloat(s.Mean()))
+}
+
+// path returns the Graphite path of a metric in the named component. If component is empty, it's left out.
+func (e *GraphiteExporter) path(component, name string) string {
+	name, unit := splitUnit(name)
+	name = strings.TrimPrefix(name, "Component/")
+
+	var b strings.Builder
+	if e.Prefix != "" {
+		b.WriteString(e.Prefix)
+		b.WriteByte('.')
+	}
+	if component != "" {
+		b.WriteString(graphiteSegment(component))
+		b.WriteByte('.')
+	}
+	for i, seg := range strings.Split(name, "/") {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(graphiteSegment(seg))
+	}
+	if unit == "%" {
+		unit = "percent"
+	}
+	if unit != "" {
+		b.WriteByte('_')
+		b.WriteString(graphiteSegment(unit))
+	}
+	return b.String()
+}
+
+// graphiteSegment returns seg with every character other than ASCII letters, digits, underscores, and hyphens replaced
+// by an underscore. An empty segment is returned as a single underscore.
+func graphiteSegment(seg string) string {
+	if seg == "" {
+		return "_"
+	}
+	b := []byte(seg)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// graphiteTags returns the Graphite tags, with their leading semicolon, of a metric in the component recorded with
+// attrs.
+func graphiteTags(com *Component, attrs Attributes) string {
+	all := make(Attributes, len(com.Attributes)+len(attrs)+1)
+	for k, v := range com.Attributes {
+		all[k] = v
+	}
+	for k, v := range attrs {
+		all[k] = v
+	}
+	all["component"] = com.Name
+
+	var b strings.Builder
+	for _, k := range all.sortedKeys() {
+		v := all[k]
+		if k == "" || v == "" {
+			continue
+		}
+		b.WriteByte(';')
+		b.WriteString(graphiteTagNameReplacer.Replace(k))
+		b.WriteByte('=')
+		if v[0] == '~' {
+			v = "_" + v[1:]
+		}
+		b.WriteString(graphiteTagValueReplacer.Replace(v))
+	}
+	return b.String()
+}
+
+var (
+	// graphiteTagNameReplacer replaces characters that can't appear in Graphite tag names.
+	graphiteTagNameReplacer = strings.NewReplacer(";", "_", "!", "_", "^", "_", "=", "_", " ", "_", "\t", "_", "\n",
+		"_", "\r", "_")
+	// graphiteTagValueReplacer replaces characters that can't appear in Graphite tag values. Values also can't start
+	// with a tilde, which graphiteTags replaces.
+	graphiteTagValueReplacer = strings.NewReplacer(";", "_", " ", "_", "\t", "_", "\n", "_", "\r", "_")
+)
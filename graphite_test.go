@@ -0,0 +1,118 @@
+package skunk
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exporterBody returns a snapshot with one component holding each kind of metric, gathered up to payloadTime.
+func exporterBody(t *testing.T) *Body {
+	return snapshotOf(t, &Body{
+		Agent: AgentRep{Host: "host", Version: "1.0"},
+		Components: []*Component{{
+			Name: "web", GUID: "com.example.web", Attributes: Attributes{"env": "prod"},
+			start: payloadTime.Add(-time.Minute),
+			Metrics: Metrics{
+				"Component/Requests[requests]":       CounterMetric(12),
+				"Component/CPU/Usage[%]":             GaugeMetric(42.5),
+				"Component/HTTP/index.html/Time[ms]": RangeMetric{}.Add(1).Add(2).Add(6),
+			},
+		}},
+	})
+}
+
+// listenGraphite starts a local TCP listener standing in for a Graphite server. Everything read from each connection
+// is sent on the returned channel once the connection is closed.
+func listenGraphite(t *testing.T) (addr string, received <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	ch := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			ch <- string(b)
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+func receiveGraphite(t *testing.T, received <-chan string) []string {
+	t.Helper()
+	select {
+	case s := <-received:
+		return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for metrics")
+		return nil
+	}
+}
+
+func TestGraphiteExporter(t *testing.T) {
+	addr, received := listenGraphite(t)
+	e := NewGraphiteExporter(addr)
+	e.Prefix = "skunk"
+	if err := e.Export(context.Background(), exporterBody(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := " " + strconv.FormatInt(payloadTime.Unix(), 10)
+	want := []string{
+		"skunk.web.CPU.Usage_percent 42.5" + ts,
+		"skunk.web.HTTP.index_html.Time_ms.count 3" + ts,
+		"skunk.web.HTTP.index_html.Time_ms.sum 9" + ts,
+		"skunk.web.HTTP.index_html.Time_ms.min 1" + ts,
+		"skunk.web.HTTP.index_html.Time_ms.max 6" + ts,
+		"skunk.web.HTTP.index_html.Time_ms.mean 3" + ts,
+		"skunk.web.Requests_requests 12" + ts,
+	}
+	if got := receiveGraphite(t, received); !reflect.DeepEqual(got, want) {
+		t.Errorf("received:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGraphiteExporterTagged(t *testing.T) {
+	addr, received := listenGraphite(t)
+	e := &GraphiteExporter{Addr: addr, Tagged: true}
+	if err := e.Export(context.Background(), exporterBody(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range receiveGraphite(t, received) {
+		path := strings.Fields(line)[0]
+		if strings.HasPrefix(path, "web.") || !strings.HasSuffix(path, ";component=web;env=prod") {
+			t.Errorf("line %q: want the component and attributes as tags only", line)
+		}
+	}
+}
+
+func TestGraphiteExporterUnreachable(t *testing.T) {
+	// Take a free port and close it, so nothing's listening there.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	e := &GraphiteExporter{Addr: addr, Timeout: time.Second}
+	if err := e.Export(context.Background(), exporterBody(t)); err == nil {
+		t.Error("Export() error = nil; want a connection error")
+	} else if _, ok := err.(*Error); ok {
+		t.Errorf("Export() error = %v; want an error that isn't an *Error, so it's retried", err)
+	}
+}
@@ -0,0 +1,138 @@
+package skunk
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RouteFunc returns the name of the route a request belongs to. Route names become part of metric names, so a RouteFunc
+// should map requests onto a small, fixed set of names (e.g., "Users/Show" rather than "/users/1234"), otherwise the
+// number of metrics a component holds grows without bound.
+type RouteFunc func(*http.Request) string
+
+// AllRoutes is the default RouteFunc. It records all requests under a single route named "All".
+func AllRoutes(*http.Request) string {
+	return "All"
+}
+
+// MethodRoute is a RouteFunc that records requests under a route named after their HTTP method.
+func MethodRoute(req *http.Request) string {
+	return req.Method
+}
+
+// Handler is an http.Handler that records metrics for each request served by its inner handler into a Component. For
+// each route, as named by Route, it records:
+//
+//	Component/HTTP/<route>/Requests[requests]     -- one per request
+//	Component/HTTP/<route>/ResponseTime[ms]       -- time taken to serve the request
+//	Component/HTTP/<route>/ResponseSize[bytes]    -- bytes written in the response body
+//	Component/HTTP/<route>/Status/<N>xx[responses] -- one per request, by status class
+//
+// The response time covers the time until the inner handler returns, not the time until the client has received the
+// full response.
+type Handler struct {
+	Handler   http.Handler
+	Component *Component
+	// Route names the route of each request. If nil, AllRoutes is used.
+	Route RouteFunc
+}
+
+// NewHandler returns a Handler that records metrics for requests served by h into c, using route to name routes. If
+// route is nil, AllRoutes is used.
+func NewHandler(c *Component, h http.Handler, route RouteFunc) *Handler {
+	return &Handler{Handler: h, Component: c, Route: route}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	route := h.Route
+	if route == nil {
+		route = AllRoutes
+	}
+	name := route(req)
+
+	rw := &responseRecorder{ResponseWriter: w}
+	start := time.Now()
+	defer func() {
+		p := recover()
+		if p != nil && rw.status == 0 {
+			// net/http will respond with a 500 (or drop the connection) after a panic.
+			rw.status = http.StatusInternalServerError
+		}
+		h.record(name, rw, time.Since(start))
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	h.Handler.ServeHTTP(rw, req)
+}
+
+// record merges the metrics for a single request into the handler's component.
+func (h *Handler) record(route string, rw *responseRecorder, elapsed time.Duration) {
+	status := rw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	prefix := "Component/HTTP/" + route + "/"
+	class := "Status/" + strconv.Itoa(status/100) + "xx[responses]"
+	ms := float64(elapsed) / float64(time.Millisecond)
+	h.Component.MergeMetrics(Metrics{
+		prefix + "Requests[requests]":  ScalarMetric(1),
+		prefix + "ResponseTime[ms]":    rangeOf(ms),
+		prefix + "ResponseSize[bytes]": rangeOf(float64(rw.written)),
+		prefix + class:                 ScalarMetric(1),
+	})
+}
+
+// responseRecorder wraps an http.ResponseWriter to record the status code and number of bytes written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rw *responseRecorder) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseRecorder) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.written += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher if the wrapped ResponseWriter does.
+func (rw *responseRecorder) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the wrapped ResponseWriter does. A hijacked connection is recorded as a 101
+// response, since nothing else about it can be known.
+func (rw *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("skunk: wrapped ResponseWriter does not implement http.Hijacker")
+	}
+	if rw.status == 0 {
+		rw.status = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+// Unwrap returns the wrapped ResponseWriter for use by http.ResponseController.
+func (rw *responseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
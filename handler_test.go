@@ -0,0 +1,151 @@
+package skunk
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// unsentMetrics returns the unsent metrics of the agent's only component, failing t if it doesn't have exactly one.
+func unsentMetrics(t *testing.T, a *Agent) Metrics {
+	t.Helper()
+	st := a.Status()
+	if len(st.Unsent.Components) != 1 {
+		t.Fatalf("got %d components; want 1", len(st.Unsent.Components))
+	}
+	return st.Unsent.Components[0].Metrics
+}
+
+func newHandlerAgent(t *testing.T) (*Agent, *Component) {
+	a := newTestAgent(t)
+	a.Start()
+	t.Cleanup(func() { a.Close() })
+	com, err := a.Component("web", "com.example.web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, com
+}
+
+func TestHandler(t *testing.T) {
+	a, com := newHandlerAgent(t)
+	h := NewHandler(com, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("not found"))
+		default:
+			// The status is implied by the first write.
+			w.Write([]byte("hello, "))
+			w.Write([]byte("world"))
+		}
+	}), MethodRoute)
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+
+	metrics := unsentMetrics(t, a)
+	delete(metrics, "Component/HTTP/GET/ResponseTime[ms]")
+	delete(metrics, "Component/HTTP/POST/ResponseTime[ms]")
+	checkMetrics(t, metrics, map[string]float64{
+		"Component/HTTP/GET/Requests[requests]":     3,
+		"Component/HTTP/GET/ResponseSize[bytes]":    33,
+		"Component/HTTP/GET/Status/2xx[responses]":  2,
+		"Component/HTTP/GET/Status/4xx[responses]":  1,
+		"Component/HTTP/POST/Requests[requests]":    1,
+		"Component/HTTP/POST/ResponseSize[bytes]":   12,
+		"Component/HTTP/POST/Status/2xx[responses]": 1,
+	})
+}
+
+func TestHandlerPanic(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		class   string
+	}{
+		{"before writing", func(http.ResponseWriter, *http.Request) { panic("boom") }, "5xx"},
+		{"after writing", func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			panic("boom")
+		}, "2xx"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, com := newHandlerAgent(t)
+			h := NewHandler(com, tt.handler, nil)
+
+			func() {
+				defer func() {
+					if p := recover(); p != "boom" {
+						t.Errorf("recovered %v; want the handler's panic", p)
+					}
+				}()
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			}()
+
+			metrics := unsentMetrics(t, a)
+			if _, ok := metrics["Component/HTTP/All/Status/"+tt.class+"[responses]"]; !ok {
+				t.Errorf("no %s response recorded: %v", tt.class, metrics)
+			}
+		})
+	}
+}
+
+// hijackWriter is a ResponseWriter that can be hijacked.
+type hijackWriter struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestHandlerPassthrough(t *testing.T) {
+	a, com := newHandlerAgent(t)
+
+	// Flushing reaches the wrapped ResponseWriter, directly or through a ResponseController.
+	rec := httptest.NewRecorder()
+	h := NewHandler(com, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("ResponseController.Flush() = %v", err)
+		}
+	}), nil)
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !rec.Flushed {
+		t.Error("Flush didn't reach the wrapped ResponseWriter")
+	}
+
+	// Hijacked connections are recorded as 101 responses.
+	hw := &hijackWriter{ResponseRecorder: httptest.NewRecorder()}
+	h = NewHandler(com, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := w.(http.Hijacker).Hijack(); err != nil {
+			t.Errorf("Hijack() = %v", err)
+		}
+	}), nil)
+	h.ServeHTTP(hw, httptest.NewRequest("GET", "/", nil))
+	if !hw.hijacked {
+		t.Error("Hijack didn't reach the wrapped ResponseWriter")
+	}
+
+	// Hijacking fails if the wrapped ResponseWriter can't be hijacked.
+	h = NewHandler(com, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			t.Error("Hijack() = nil; want an error")
+		}
+	}), nil)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	metrics := unsentMetrics(t, a)
+	if _, ok := metrics["Component/HTTP/All/Status/1xx[responses]"]; !ok {
+		t.Errorf("no 1xx response recorded for the hijacked connection: %v", metrics)
+	}
+}
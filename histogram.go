@@ -0,0 +1,98 @@
+package skunk
+
+import "sort"
+
+// DefaultHistogramBounds are the default bucket bounds of a HistogramMetric. They're suited to durations recorded in
+// milliseconds.
+var DefaultHistogramBounds = []float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// HistogramMetric is a RangeMetric that also counts the values recorded in buckets, each holding the values less than
+// or equal to its upper bound and greater than the previous bucket's bound. Values greater than the last bound are
+// counted in an overflow bucket. To NewRelic's plugin API, a HistogramMetric is sent as its RangeMetric, but exporters
+// that support histograms (such as PrometheusExporter) send its buckets too.
+//
+// HistogramMetrics are built from an empty histogram returned by NewHistogramMetric. For example:
+//
+//	com.MergeMetric("Component/DB/Latency[ms]", NewHistogramMetric(DefaultHistogramBounds...).Add(ms))
+//
+// Merging histograms with different bounds, or a histogram with a RangeMetric of more than one value, loses the
+// buckets, since there's no telling which bucket those values belong in, and produces a RangeMetric.
+type HistogramMetric struct {
+	RangeMetric
+	// Bounds are the upper bounds of the buckets, in ascending order. They're shared between histograms built from
+	// the same NewHistogramMetric, so they must not be modified.
+	Bounds []float64 `json:"-"`
+	// Counts are the number of values in each bucket. The last count is the overflow bucket, so there's one more count
+	// than there are bounds.
+	Counts []uint64 `json:"-"`
+}
+
+// NewHistogramMetric returns an empty HistogramMetric with the given bucket bounds.
+func NewHistogramMetric(bounds ...float64) HistogramMetric {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	return HistogramMetric{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h HistogramMetric) Add(value float64) Metric {
+	counts := h.copyCounts()
+	counts[sort.SearchFloat64s(h.Bounds, value)]++
+	return HistogramMetric{
+		RangeMetric: h.RangeMetric.Add(value).(RangeMetric),
+		Bounds:      h.Bounds,
+		Counts:      counts,
+	}
+}
+
+func (h HistogramMetric) Merge(value Metric) Metric {
+	switch o := value.(type) {
+	case ScalarMetric:
+		return h.Add(float64(o))
+	case RangeMetric:
+		switch o.Count {
+		case 0:
+			return h
+		case 1:
+			return h.Add(o.Total)
+		}
+	case HistogramMetric:
+		if !sameBounds(h.Bounds, o.Bounds) {
+			return h.RangeMetric.Merge(o.RangeMetric)
+		}
+
+		counts := h.copyCounts()
+		for i, n := range o.Counts {
+			counts[i] += n
+		}
+		return HistogramMetric{
+			RangeMetric: h.RangeMetric.Merge(o.RangeMetric).(RangeMetric),
+			Bounds:      h.Bounds,
+			Counts:      counts,
+		}
+	}
+	return h.RangeMetric.Merge(value)
+}
+
+// copyCounts returns a copy of the histogram's counts with one for each bucket. A histogram that wasn't built by
+// NewHistogramMetric, such as the zero value, may have too few, in which case the rest are zero.
+func (h HistogramMetric) copyCounts() []uint64 {
+	n := len(h.Bounds) + 1
+	if len(h.Counts) > n {
+		n = len(h.Counts)
+	}
+	counts := make([]uint64, n)
+	copy(counts, h.Counts)
+	return counts
+}
+
+func sameBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package skunk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHistogramMetricZeroValue(t *testing.T) {
+	// The zero value has no bounds, so every value lands in the overflow bucket.
+	var m Metric = HistogramMetric{}
+	m = m.Add(1).Add(2)
+	m = m.Merge(HistogramMetric{}.Add(3))
+	m = m.Merge(HistogramMetric{})
+
+	h := m.(HistogramMetric)
+	if len(h.Counts) != 1 || h.Counts[0] != 3 || h.Count != 3 || h.Total != 6 {
+		t.Errorf("zero value histogram = %+v; want 3 values in one bucket", h)
+	}
+
+	// Histograms with too few counts are treated as having empty buckets.
+	h = HistogramMetric{Bounds: []float64{1, 10}}.Add(5).(HistogramMetric)
+	if got, want := fmt.Sprint(h.Counts), "[0 1 0]"; got != want {
+		t.Errorf("Counts = %s; want %s", got, want)
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writePrometheus(w, "", map[string]promEntry{"h": {component: "app", guid: "com.example.app", series: Series{
+		Name:   "Component/Latency[ms]",
+		Metric: HistogramMetric{},
+	}}})
+	w.Flush()
+	if !strings.Contains(buf.String(), `le="+Inf"} 0`) {
+		t.Errorf("zero value histogram missing +Inf bucket:\n%s", buf.String())
+	}
+}
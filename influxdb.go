@@ -0,0 +1,175 @@
+package skunk
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultInfluxDBBatchSize is the default number of lines an InfluxDBExporter sends per request.
+const DefaultInfluxDBBatchSize = 5000
+
+// InfluxDBExporter is an Exporter that writes metrics to an InfluxDB write endpoint in its line protocol. Each metric
+// is written as a point timestamped with the time its component's metrics were gathered up to, tagged with its
+// component's name and GUID (as component and guid), the agent's host, its unit (as unit), and the component's
+// attributes and those of the metric, which aren't flattened into the measurement. CounterMetrics, GaugeMetrics, and
+// ScalarMetrics are written with a single value field. RangeMetrics, and any other kind of metric, are written with
+// count, sum, min, max, and mean fields.
+//
+// Measurements are the metric's name with any leading Component/ segment and its unit removed and slashes replaced by
+// dots. For example, Component/HTTP/index/ResponseTime[ms] is written as the measurement HTTP.index.ResponseTime with
+// unit=ms. Tags with empty values are left out, since InfluxDB doesn't allow them.
+//
+// Lines are sent in batches of up to BatchSize lines. If a batch fails, batches already sent aren't taken back, but
+// since points are identified by their measurement, tags, and timestamp, a retried send overwrites them.
+type InfluxDBExporter struct {
+	// URL is the write endpoint, including its query parameters. For InfluxDB 1.x, this is something like
+	// http://localhost:8086/write?db=metrics, and for 2.x, http://localhost:8086/api/v2/write?org=o&bucket=b.
+	// Credentials for 1.x may be given as the URL's user info.
+	URL string
+	// Token, if set, is sent as an Authorization: Token header, as used by InfluxDB 2.x.
+	Token string
+	// Prefix, if set, is prepended to every measurement, followed by a dot.
+	Prefix string
+	// Client is the HTTP client used to write metrics. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// BatchSize is the maximum number of lines sent per request. If zero or less, DefaultInfluxDBBatchSize is used.
+	BatchSize int
+}
+
+// NewInfluxDBExporter returns an InfluxDBExporter writing to the given write endpoint URL.
+func NewInfluxDBExporter(url string) *InfluxDBExporter {
+	return &InfluxDBExporter{URL: url}
+}
+
+func (e *InfluxDBExporter) Export(ctx context.Context, body *Body) error {
+	size := e.BatchSize
+	if size <= 0 {
+		size = DefaultInfluxDBBatchSize
+	}
+
+	var (
+		buf bytes.Buffer
+		n   int
+	)
+	for _, com := range body.Components {
+		ts := " " + strconv.FormatInt(com.start.Add(com.Duration.Duration).UnixNano(), 10) + "\n"
+		for _, s := range com.Series() {
+			e.writeLine(&buf, body.Agent.Host, com, s, ts)
+			if n++; n == size {
+				if err := e.post(ctx, buf.Bytes()); err != nil {
+					return err
+				}
+				buf.Reset()
+				n = 0
+			}
+		}
+	}
+
+	if n == 0 {
+		return nil
+	}
+	return e.post(ctx, buf.Bytes())
+}
+
+// writeLine writes the line protocol of a single series in the component to buf.
+func (e *InfluxDBExporter) writeLine(buf *bytes.Buffer, host string, com *Component, s Series, ts string) {
+	name, unit := splitUnit(s.Name)
+	name = strings.Replace(strings.TrimPrefix(name, "Component/"), "/", ".", -1)
+	if e.Prefix != "" {
+		name = e.Prefix + "." + name
+	}
+	buf.WriteString(influxMeasurementReplacer.Replace(name))
+
+	tags := make(Attributes, len(com.Attributes)+len(s.Attributes)+4)
+	for k, v := range com.Attributes {
+		tags[k] = v
+	}
+	for k, v := range s.Attributes {
+		tags[k] = v
+	}
+	tags["component"] = com.Name
+	tags["guid"] = com.GUID
+	tags["host"] = host
+	tags["unit"] = unit
+	for _, k := range tags.sortedKeys() {
+		if k == "" || tags[k] == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(influxTagReplacer.Replace(k))
+		buf.WriteByte('=')
+		buf.WriteString(influxTagReplacer.Replace(tags[k]))
+	}
+
+	buf.WriteByte(' ')
+	switch m := s.Metric.(type) {
+	case CounterMetric:
+		buf.WriteString("value=" + formatFloat(float64(m)))
+	case GaugeMetric:
+		buf.WriteString("value=" + formatFloat(float64(m)))
+	case ScalarMetric:
+		buf.WriteString("value=" + formatFloat(float64(m)))
+	default:
+		sum, _ := summarize(m)
+		buf.WriteString("count=" + strconv.Itoa(sum.Count) + "i")
+		buf.WriteString(",sum=" + formatFloat(sum.Total))
+		buf.WriteString(",min=" + formatFloat(sum.Min))
+		buf.WriteString(",max=" + formatFloat(sum.Max))
+		buf.WriteString(",mean=" + formatFloat(sum.Mean()))
+	}
+	buf.WriteString(ts)
+}
+
+var (
+	// influxMeasurementReplacer escapes commas and spaces in measurements. Line breaks can't be escaped, so they're
+	// replaced by underscores.
+	influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", "_", "\r", "_")
+	// influxTagReplacer escapes commas, equals signs, and spaces in tag keys and values. Line breaks can't be escaped,
+	// so they're replaced by underscores.
+	influxTagReplacer = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", "_", "\r", "_")
+)
+
+func (e *InfluxDBExporter) post(ctx context.Context, lines []byte) error {
+	var buf bytes.Buffer
+	err := compress(&buf, GzipCompression, 0, func(w io.Writer) error {
+		_, err := w.Write(lines)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.URL, &buf)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	if e.Token != "" {
+		req.Header.Set("Authorization", "Token "+e.Token)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		// InfluxDB rejects missing or invalid credentials with a 401, which is as final as NewRelic's 403.
+		return mkerr(ErrForbidden, nil)
+	}
+	return statusError(resp)
+}
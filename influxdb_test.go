@@ -0,0 +1,107 @@
+package skunk
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// influxServer is a stand-in for an InfluxDB write endpoint that records the lines of each request it receives and
+// responds with status.
+type influxServer struct {
+	*httptest.Server
+	status int
+
+	mu       sync.Mutex
+	requests []*http.Request
+	batches  [][]string
+}
+
+func newInfluxServer(t *testing.T, status int) *influxServer {
+	s := &influxServer{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("invalid gzip body: %v", err)
+			return
+		}
+		b, _ := ioutil.ReadAll(zr)
+
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.batches = append(s.batches, strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"))
+		s.mu.Unlock()
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestInfluxDBExporter(t *testing.T) {
+	s := newInfluxServer(t, http.StatusNoContent)
+	e := NewInfluxDBExporter(s.URL + "/api/v2/write?org=o&bucket=b")
+	e.Token = "secret"
+	if err := e.Export(context.Background(), exporterBody(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.batches) != 1 {
+		t.Fatalf("got %d requests; want 1", len(s.batches))
+	}
+	r := s.requests[0]
+	if got := r.Header.Get("Authorization"); got != "Token secret" {
+		t.Errorf("Authorization = %q; want Token secret", got)
+	}
+	if got := r.URL.Query().Get("bucket"); got != "b" {
+		t.Errorf("bucket = %q; want b", got)
+	}
+
+	ts := " " + strconv.FormatInt(payloadTime.UnixNano(), 10)
+	tags := ",component=web,env=prod,guid=com.example.web,host=host"
+	want := []string{
+		"CPU.Usage" + tags + ",unit=% value=42.5" + ts,
+		"HTTP.index.html.Time" + tags + ",unit=ms count=3i,sum=9,min=1,max=6,mean=3" + ts,
+		"Requests" + tags + ",unit=requests value=12" + ts,
+	}
+	if got := s.batches[0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("received:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestInfluxDBExporterBatches(t *testing.T) {
+	s := newInfluxServer(t, http.StatusNoContent)
+	e := &InfluxDBExporter{URL: s.URL + "/write?db=metrics", BatchSize: 2}
+	if err := e.Export(context.Background(), exporterBody(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.batches) != 2 || len(s.batches[0]) != 2 || len(s.batches[1]) != 1 {
+		t.Errorf("batches = %q; want 2 lines then 1", s.batches)
+	}
+}
+
+func TestInfluxDBExporterErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		want   int
+	}{
+		{http.StatusBadRequest, ErrBadPayload},
+		{http.StatusUnauthorized, ErrForbidden},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusServiceUnavailable, errMustRetry},
+	}
+	for _, tt := range tests {
+		s := newInfluxServer(t, tt.status)
+		e := NewInfluxDBExporter(s.URL + "/write?db=metrics")
+		if err := e.Export(context.Background(), exporterBody(t)); !iserr(err, tt.want) {
+			t.Errorf("status %d: Export() error = %v; want %v", tt.status, err, tt.want)
+		}
+	}
+}
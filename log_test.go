@@ -0,0 +1,162 @@
+package skunk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// capturedRecord is a log record kept by captureHandler, with its attributes as strings.
+type capturedRecord struct {
+	level slog.Level
+	msg   string
+	attrs map[string]string
+}
+
+// captureHandler is a slog.Handler that keeps every record it handles.
+type captureHandler struct {
+	mu      sync.Mutex
+	records []capturedRecord
+	logged  chan struct{}
+}
+
+func newCaptureHandler() *captureHandler {
+	return &captureHandler{logged: make(chan struct{}, 100)}
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	rec := capturedRecord{level: r.Level, msg: r.Message, attrs: make(map[string]string)}
+	r.Attrs(func(a slog.Attr) bool {
+		rec.attrs[a.Key] = a.Value.String()
+		return true
+	})
+	h.mu.Lock()
+	h.records = append(h.records, rec)
+	h.mu.Unlock()
+	select {
+	case h.logged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// find returns the first record with the given message, waiting up to timeout for it to be logged.
+func (h *captureHandler) find(msg string, timeout time.Duration) (capturedRecord, bool) {
+	deadline := time.After(timeout)
+	for {
+		h.mu.Lock()
+		for _, r := range h.records {
+			if r.msg == msg {
+				h.mu.Unlock()
+				return r, true
+			}
+		}
+		h.mu.Unlock()
+
+		select {
+		case <-h.logged:
+		case <-deadline:
+			return capturedRecord{}, false
+		}
+	}
+}
+
+func TestLoggerReceivesMessages(t *testing.T) {
+	h := newCaptureHandler()
+	a := newTestAgent(t)
+	a.Logger = slog.New(h)
+	body := spanBody(t, payloadTime, payloadTime.Add(time.Minute), 1)
+
+	newDestination(a, "down", failingExporter{errors.New("connection refused")}, time.Second).send(body, false)
+	newDestination(a, "picky", failingExporter{mkerr(ErrBadPayload, nil)}, time.Second).send(body, false)
+
+	tests := []struct {
+		msg   string
+		level slog.Level
+		attrs map[string]string
+	}{
+		{"skunk: destination is unavailable, retrying send", slog.LevelWarn, map[string]string{
+			"destination": "down",
+			"retry_delay": retryDelay.String(),
+			"error":       "connection refused",
+		}},
+		{"skunk: destination rejected metrics", slog.LevelError, map[string]string{
+			"destination": "picky",
+			"error":       mkerr(ErrBadPayload, nil).Error(),
+		}},
+	}
+	for _, tt := range tests {
+		r, ok := h.find(tt.msg, time.Second)
+		if !ok {
+			t.Errorf("%q not logged", tt.msg)
+			continue
+		}
+		if r.level != tt.level {
+			t.Errorf("%q logged at %v; want %v", tt.msg, r.level, tt.level)
+		}
+		for k, v := range tt.attrs {
+			if r.attrs[k] != v {
+				t.Errorf("%q attribute %s = %q; want %q", tt.msg, k, r.attrs[k], v)
+			}
+		}
+	}
+}
+
+func TestLoggerFromRunloop(t *testing.T) {
+	// Messages logged from the runloop reach the Logger too.
+	h := newCaptureHandler()
+	a := newTestAgent(t)
+	a.Logger = slog.New(h)
+	a.Start()
+	defer a.Close()
+
+	a.ops <- nil
+	r, ok := h.find("skunk: skipping op", 5*time.Second)
+	if !ok {
+		t.Fatal("nil op not logged")
+	}
+	if r.level != slog.LevelError || !strings.Contains(r.attrs["error"], "nil") {
+		t.Errorf("logged %+v; want an error about the nil op", r)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for use by multiple goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLoggerDefaultsToLog(t *testing.T) {
+	var buf syncBuffer
+	a := newTestAgent(t)
+	a.Logger = nil
+	a.Log = &buf
+	a.Start()
+	a.ops <- nil
+	a.Close()
+
+	if out := buf.String(); !strings.Contains(out, `level=ERROR msg="skunk: skipping op"`) {
+		t.Errorf("Log = %q; want the runloop's error as text", out)
+	}
+}
@@ -0,0 +1,215 @@
+package skunk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// MetricAPI is the URL of NewRelic's dimensional Metric API. This may be altered to change the default endpoint of new
+// MetricAPIExporters (e.g., to https://metric-api.eu.newrelic.com/metric/v1 for EU accounts).
+var MetricAPI = `https://metric-api.newrelic.com/metric/v1`
+
+// DefaultMetricAPIBatchSize is the default number of metrics a MetricAPIExporter sends per request.
+const DefaultMetricAPIBatchSize = 5000
+
+// MetricAPIExporter is an Exporter that sends metrics to NewRelic's dimensional Metric API. Each component's name and
+// GUID, along with the agent's host, PID, and version, are sent as common attributes of its metrics:
+//
+//	component.name, component.guid, host, pid, agent.version
+//
+// The component's own Attributes are sent as common attributes too, and metrics recorded with attributes are sent with
+// them as-is, rather than flattened into their names.
+//
+// Metric names are sent without their unit, which is sent as the unit attribute instead. So, for example,
+// Component/HTTP/index/ResponseTime[ms] is sent as Component/HTTP/index/ResponseTime with unit=ms.
+//
+// CounterMetrics are sent as counts and GaugeMetrics and ScalarMetrics as gauges. RangeMetrics, and any other kind of
+// metric, are sent as summaries of their values.
+//
+// Metrics are sent in batches of up to BatchSize metrics. If a batch fails, batches already sent aren't taken back, so
+// a retried send may duplicate some metrics.
+type MetricAPIExporter struct {
+	// URL is the Metric API endpoint. If empty, MetricAPI is used.
+	URL string
+	// APIKey is the license or insert key sent as the Api-Key header.
+	APIKey string
+	// Client is the HTTP client used to send metrics. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// BatchSize is the maximum number of metrics sent per request. If zero or less, DefaultMetricAPIBatchSize is
+	// used.
+	BatchSize int
+	// Attributes are additional attributes sent with every metric, such as a service or environment name.
+	Attributes map[string]interface{}
+}
+
+// NewMetricAPIExporter returns a MetricAPIExporter that sends metrics to the default Metric API endpoint using the given
+// API key.
+func NewMetricAPIExporter(apiKey string) (*MetricAPIExporter, error) {
+	if len(apiKey) == 0 {
+		return nil, mkerr(ErrNoAPIKey, nil)
+	}
+	return &MetricAPIExporter{URL: MetricAPI, APIKey: apiKey}, nil
+}
+
+// metricAPIBatch is a set of metrics sharing common attributes, as sent to the Metric API. A request body is an array
+// of these.
+type metricAPIBatch struct {
+	Common  metricAPICommon  `json:"common"`
+	Metrics []metricAPIPoint `json:"metrics"`
+}
+
+type metricAPICommon struct {
+	Timestamp  int64                  `json:"timestamp"`
+	Interval   int64                  `json:"interval.ms"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+type metricAPIPoint struct {
+	Name       string                 `json:"name"`
+	Type       string                 `json:"type"`
+	Value      interface{}            `json:"value"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// metricAPISummary is the value of a summary metric.
+type metricAPISummary struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+func (e *MetricAPIExporter) Export(ctx context.Context, body *Body) error {
+	size := e.BatchSize
+	if size <= 0 {
+		size = DefaultMetricAPIBatchSize
+	}
+
+	var (
+		batches []metricAPIBatch
+		n       int
+	)
+	for _, com := range body.Components {
+		common := e.common(body.Agent, com)
+		series := com.Series()
+		points := make([]metricAPIPoint, 0, len(series))
+		for _, s := range series {
+			points = append(points, metricAPIPointOf(s))
+		}
+
+		// Split the component's metrics across as many batches as needed.
+		for len(points) > 0 {
+			take := size - n
+			if take > len(points) {
+				take = len(points)
+			}
+			batches = append(batches, metricAPIBatch{Common: common, Metrics: points[:take]})
+			points, n = points[take:], n+take
+
+			if n == size {
+				if err := e.post(ctx, batches); err != nil {
+					return err
+				}
+				batches, n = nil, 0
+			}
+		}
+	}
+
+	if len(batches) == 0 {
+		return nil
+	}
+	return e.post(ctx, batches)
+}
+
+// common returns the common block for the component's metrics.
+func (e *MetricAPIExporter) common(rep AgentRep, com *Component) metricAPICommon {
+	attrs := make(map[string]interface{}, len(e.Attributes)+len(com.Attributes)+5)
+	for k, v := range e.Attributes {
+		attrs[k] = v
+	}
+	for k, v := range com.Attributes {
+		attrs[k] = v
+	}
+	attrs["component.name"] = com.Name
+	attrs["component.guid"] = com.GUID
+	attrs["host"] = rep.Host
+	attrs["agent.version"] = rep.Version
+	if rep.PID != 0 {
+		attrs["pid"] = rep.PID
+	}
+
+	return metricAPICommon{
+		Timestamp:  com.start.UnixNano() / int64(time.Millisecond),
+		Interval:   int64(com.Duration.Duration / time.Millisecond),
+		Attributes: attrs,
+	}
+}
+
+func metricAPIPointOf(s Series) metricAPIPoint {
+	name, unit := splitUnit(s.Name)
+	p := metricAPIPoint{Name: name}
+	if unit != "" || len(s.Attributes) > 0 {
+		p.Attributes = make(map[string]interface{}, len(s.Attributes)+1)
+		for k, v := range s.Attributes {
+			p.Attributes[k] = v
+		}
+		if unit != "" {
+			p.Attributes["unit"] = unit
+		}
+	}
+
+	switch m := s.Metric.(type) {
+	case CounterMetric:
+		p.Type, p.Value = "count", float64(m)
+	case GaugeMetric:
+		p.Type, p.Value = "gauge", float64(m)
+	case ScalarMetric:
+		p.Type, p.Value = "gauge", float64(m)
+	default:
+		s, _ := summarize(m)
+		p.Type, p.Value = "summary", metricAPISummary{Count: s.Count, Sum: s.Total, Min: s.Min, Max: s.Max}
+	}
+	return p
+}
+
+func (e *MetricAPIExporter) post(ctx context.Context, batches []metricAPIBatch) error {
+	var buf bytes.Buffer
+	err := compress(&buf, GzipCompression, 0, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(batches)
+	})
+	if err != nil {
+		return mkerr(ErrEncodingJSON, err)
+	}
+
+	url := e.URL
+	if url == "" {
+		url = MetricAPI
+	}
+	req, err := http.NewRequest("POST", url, &buf)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Api-Key", e.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return statusError(resp)
+}
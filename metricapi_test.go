@@ -0,0 +1,180 @@
+package skunk
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// metricAPIServer is a stand-in for the Metric API that records the batches of each request it receives and responds
+// with status.
+type metricAPIServer struct {
+	*httptest.Server
+	status int
+
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]metricAPIBatch
+}
+
+func newMetricAPIServer(t *testing.T, status int) *metricAPIServer {
+	s := &metricAPIServer{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batches []metricAPIBatch
+		zr, err := gzip.NewReader(r.Body)
+		if err == nil {
+			err = json.NewDecoder(zr).Decode(&batches)
+		}
+		if err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+
+		s.mu.Lock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, batches)
+		s.mu.Unlock()
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// metricAPIBody returns a snapshot with two components: web, with one metric of each kind and one with attributes, and
+// db, with two gauges.
+func metricAPIBody(t *testing.T) *Body {
+	attrs := Attributes{"route": "/index"}
+	return snapshotOf(t, &Body{
+		Agent: AgentRep{Host: "host", PID: 7, Version: "1.0"},
+		Components: []*Component{
+			{
+				Name: "web", GUID: "com.example.web", Attributes: Attributes{"env": "prod"},
+				start: payloadTime.Add(-time.Minute),
+				Metrics: Metrics{
+					"Component/Requests[requests]": CounterMetric(12),
+					"Component/CPU/Usage[%]":       GaugeMetric(42.5),
+					"Component/Load":               ScalarMetric(0.5),
+					"Component/Time[ms]":           RangeMetric{}.Add(1).Add(2).Add(6),
+				},
+				series: map[string]Series{
+					seriesKey("Component/Hits[hits]", attrs): {
+						Name: "Component/Hits[hits]", Attributes: attrs, Metric: CounterMetric(3),
+					},
+				},
+			},
+			{
+				Name: "db", GUID: "com.example.db", start: payloadTime.Add(-30 * time.Second),
+				Metrics: Metrics{
+					"Component/Connections[conns]": GaugeMetric(4),
+					"Component/Queries[queries]":   GaugeMetric(9),
+				},
+			},
+		},
+	})
+}
+
+func TestMetricAPIExporter(t *testing.T) {
+	s := newMetricAPIServer(t, http.StatusAccepted)
+	e := &MetricAPIExporter{URL: s.URL, APIKey: "secret", Attributes: map[string]interface{}{"service": "shop"}}
+	if err := e.Export(context.Background(), metricAPIBody(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.requests) != 1 {
+		t.Fatalf("got %d requests; want 1", len(s.requests))
+	}
+	r := s.requests[0]
+	if r.Header.Get("Api-Key") != "secret" || r.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("headers = %v", r.Header)
+	}
+
+	batches := s.bodies[0]
+	if len(batches) != 2 {
+		t.Fatalf("got %d batches; want 2", len(batches))
+	}
+
+	web := batches[0]
+	wantCommon := metricAPICommon{
+		Timestamp: payloadTime.Add(-time.Minute).UnixNano() / int64(time.Millisecond),
+		Interval:  int64(time.Minute / time.Millisecond),
+		Attributes: map[string]interface{}{
+			"service": "shop", "env": "prod",
+			"component.name": "web", "component.guid": "com.example.web",
+			"host": "host", "agent.version": "1.0", "pid": 7.0,
+		},
+	}
+	if !reflect.DeepEqual(web.Common, wantCommon) {
+		t.Errorf("common = %+v; want %+v", web.Common, wantCommon)
+	}
+
+	// Points are sorted by name, sent without their units, and typed by kind of metric.
+	wantPoints := []metricAPIPoint{
+		{Name: "Component/CPU/Usage", Type: "gauge", Value: 42.5, Attributes: map[string]interface{}{"unit": "%"}},
+		{Name: "Component/Hits", Type: "count", Value: 3.0,
+			Attributes: map[string]interface{}{"unit": "hits", "route": "/index"}},
+		{Name: "Component/Load", Type: "gauge", Value: 0.5},
+		{Name: "Component/Requests", Type: "count", Value: 12.0,
+			Attributes: map[string]interface{}{"unit": "requests"}},
+		{Name: "Component/Time", Type: "summary",
+			Value:      map[string]interface{}{"count": 3.0, "sum": 9.0, "min": 1.0, "max": 6.0},
+			Attributes: map[string]interface{}{"unit": "ms"}},
+	}
+	if !reflect.DeepEqual(web.Metrics, wantPoints) {
+		t.Errorf("web metrics = %+v; want %+v", web.Metrics, wantPoints)
+	}
+
+	db := batches[1]
+	if db.Common.Attributes["component.name"] != "db" || db.Common.Attributes["env"] != nil {
+		t.Errorf("db attributes = %v", db.Common.Attributes)
+	}
+	if db.Common.Interval != int64(30*time.Second/time.Millisecond) || len(db.Metrics) != 2 {
+		t.Errorf("db batch = %+v", db)
+	}
+}
+
+func TestMetricAPIExporterBatches(t *testing.T) {
+	s := newMetricAPIServer(t, http.StatusAccepted)
+	e := &MetricAPIExporter{URL: s.URL, BatchSize: 3}
+	if err := e.Export(context.Background(), metricAPIBody(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Batches are split across and within components, each carrying its component's common attributes.
+	type batch struct {
+		component string
+		points    int
+	}
+	want := [][]batch{
+		{{"web", 3}},
+		{{"web", 2}, {"db", 1}},
+		{{"db", 1}},
+	}
+	var got [][]batch
+	for _, body := range s.bodies {
+		var req []batch
+		for _, b := range body {
+			req = append(req, batch{b.Common.Attributes["component.name"].(string), len(b.Metrics)})
+		}
+		got = append(got, req)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %v; want %v", got, want)
+	}
+}
+
+func TestMetricAPIExporterError(t *testing.T) {
+	s := newMetricAPIServer(t, http.StatusForbidden)
+	e := &MetricAPIExporter{URL: s.URL, BatchSize: 3}
+	if err := e.Export(context.Background(), metricAPIBody(t)); err == nil {
+		t.Fatal("Export() = nil; want an error")
+	}
+	// Later batches aren't sent once one fails.
+	if len(s.requests) != 1 {
+		t.Errorf("got %d requests; want 1", len(s.requests))
+	}
+}
@@ -0,0 +1,370 @@
+package skunk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OTLPEndpoint is the default URL OTLPExporters send metrics to. It's the metrics endpoint of an OpenTelemetry
+// collector's OTLP/HTTP receiver on the local host.
+var OTLPEndpoint = `http://localhost:4318/v1/metrics`
+
+// OTLPExporter is an Exporter that sends metrics to an OpenTelemetry collector, or anything else that accepts
+// OTLP/HTTP, using OTLP's JSON encoding. The agent is sent as the resource, with its host, PID, and version as the
+// host.name, process.pid, and service.version attributes, and each component is sent as an instrumentation scope named
+// after the component, with its GUID (as guid) and attributes as the scope's attributes. Metrics recorded with
+// attributes are sent with them as data point attributes.
+//
+// Since an agent sends only the metrics recorded since its last send, metrics are sent with delta temporality:
+//
+//	CounterMetric          monotonic sum
+//	GaugeMetric            gauge
+//	ScalarMetric           gauge
+//	HistogramMetric        histogram with its buckets
+//	RangeMetric and others histogram with a single bucket, along with its minimum and maximum
+//
+// Metric names are sent with any leading Component/ segment and their unit removed. Units are sent as the metric's
+// unit, as-is if they're a common UCUM unit (such as ms, s, or %) and as an annotation (e.g., {requests}) otherwise.
+// For example, Component/HTTP/index/Requests[requests] is sent as HTTP/index/Requests with unit {requests}.
+type OTLPExporter struct {
+	// URL is the OTLP/HTTP metrics endpoint. If empty, OTLPEndpoint is used.
+	URL string
+	// Headers are additional headers sent with every request, such as those needed to authenticate.
+	Headers map[string]string
+	// Client is the HTTP client used to send metrics. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// Attributes are additional resource attributes, such as service.name.
+	Attributes map[string]interface{}
+}
+
+// NewOTLPExporter returns an OTLPExporter that sends metrics to the default OTLP endpoint.
+func NewOTLPExporter() *OTLPExporter {
+	return &OTLPExporter{URL: OTLPEndpoint}
+}
+
+// The types below are the parts of OTLP's metrics data model used by OTLPExporter, as encoded in JSON. 64-bit integers
+// are encoded as strings.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name       string         `json:"name"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpMetric struct {
+	Name      string         `json:"name"`
+	Unit      string         `json:"unit,omitempty"`
+	Sum       *otlpSum       `json:"sum,omitempty"`
+	Gauge     *otlpGauge     `json:"gauge,omitempty"`
+	Histogram *otlpHistogram `json:"histogram,omitempty"`
+}
+
+// otlpDeltaTemporality is AGGREGATION_TEMPORALITY_DELTA.
+const otlpDeltaTemporality = 1
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds,omitempty"`
+	Min               float64        `json:"min"`
+	Max               float64        `json:"max"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, body *Body) error {
+	resource := otlpResource{Attributes: otlpAttributes(e.Attributes)}
+	resource.Attributes = append(resource.Attributes,
+		otlpKeyValue{"host.name", otlpValue(body.Agent.Host)},
+		otlpKeyValue{"service.version", otlpValue(body.Agent.Version)},
+	)
+	if body.Agent.PID != 0 {
+		resource.Attributes = append(resource.Attributes, otlpKeyValue{"process.pid", otlpValue(body.Agent.PID)})
+	}
+
+	rm := otlpResourceMetrics{Resource: resource}
+	for _, com := range body.Components {
+		scope := otlpScope{Name: com.Name, Attributes: otlpStringAttributes(com.Attributes)}
+		scope.Attributes = append(scope.Attributes, otlpKeyValue{"guid", otlpValue(com.GUID)})
+
+		start := strconv.FormatInt(com.start.UnixNano(), 10)
+		end := strconv.FormatInt(com.start.Add(com.Duration.Duration).UnixNano(), 10)
+
+		// Series of the same name and kind are sent as data points of a single metric.
+		var (
+			metrics []*otlpMetric
+			index   = make(map[string]*otlpMetric)
+		)
+		for _, s := range com.Series() {
+			key := s.Name + "\x00" + otlpKind(s.Metric)
+			m, ok := index[key]
+			if !ok {
+				m = newOTLPMetric(s)
+				index[key] = m
+				metrics = append(metrics, m)
+			}
+			m.addPoint(s, start, end)
+		}
+
+		out := make([]otlpMetric, len(metrics))
+		for i, m := range metrics {
+			out[i] = *m
+		}
+		rm.ScopeMetrics = append(rm.ScopeMetrics, otlpScopeMetrics{Scope: scope, Metrics: out})
+	}
+
+	if len(rm.ScopeMetrics) == 0 {
+		return nil
+	}
+	return e.post(ctx, otlpRequest{ResourceMetrics: []otlpResourceMetrics{rm}})
+}
+
+// otlpKind returns the kind of OTLP metric m is sent as.
+func otlpKind(m Metric) string {
+	switch m.(type) {
+	case CounterMetric:
+		return "sum"
+	case GaugeMetric, ScalarMetric:
+		return "gauge"
+	}
+	return "histogram"
+}
+
+// newOTLPMetric returns an OTLP metric without data points for the series' name and kind.
+func newOTLPMetric(s Series) *otlpMetric {
+	name, unit := splitUnit(s.Name)
+	m := &otlpMetric{Name: strings.TrimPrefix(name, "Component/"), Unit: otlpUnit(unit)}
+	switch otlpKind(s.Metric) {
+	case "sum":
+		m.Sum = &otlpSum{AggregationTemporality: otlpDeltaTemporality, IsMonotonic: true}
+	case "gauge":
+		m.Gauge = &otlpGauge{}
+	default:
+		m.Histogram = &otlpHistogram{AggregationTemporality: otlpDeltaTemporality}
+	}
+	return m
+}
+
+// addPoint adds the series to the metric as a data point. The metric must have been created for the series' kind.
+func (m *otlpMetric) addPoint(s Series, start, end string) {
+	attrs := otlpStringAttributes(s.Attributes)
+	switch v := s.Metric.(type) {
+	case CounterMetric:
+		m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberDataPoint{attrs, start, end, float64(v)})
+	case GaugeMetric:
+		m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberDataPoint{attrs, start, end, float64(v)})
+	case ScalarMetric:
+		m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberDataPoint{attrs, start, end, float64(v)})
+	default:
+		sum, _ := summarize(v)
+		count := strconv.Itoa(sum.Count)
+		p := otlpHistogramDataPoint{
+			Attributes:        attrs,
+			StartTimeUnixNano: start,
+			TimeUnixNano:      end,
+			Count:             count,
+			Sum:               sum.Total,
+			BucketCounts:      []string{count},
+			Min:               sum.Min,
+			Max:               sum.Max,
+		}
+		if h, ok := v.(HistogramMetric); ok {
+			counts := h.copyCounts()
+			p.ExplicitBounds = h.Bounds
+			p.BucketCounts = make([]string, len(counts))
+			for i, n := range counts {
+				p.BucketCounts[i] = strconv.FormatUint(n, 10)
+			}
+		}
+		m.Histogram.DataPoints = append(m.Histogram.DataPoints, p)
+	}
+}
+
+// otlpUnits are the UCUM units sent as-is. Any other unit is sent as an annotation.
+var otlpUnits = map[string]bool{
+	"1": true, "%": true,
+	"ns": true, "us": true, "ms": true, "s": true, "min": true, "h": true, "d": true,
+	"By": true, "KiBy": true, "MiBy": true, "GiBy": true, "bit": true,
+}
+
+func otlpUnit(unit string) string {
+	if unit == "" || otlpUnits[unit] {
+		return unit
+	}
+	return "{" + strings.NewReplacer("{", "_", "}", "_").Replace(unit) + "}"
+}
+
+// otlpAttributes returns attrs as OTLP key/values, sorted by key.
+func otlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, k := range keys {
+		kvs = append(kvs, otlpKeyValue{k, otlpValue(attrs[k])})
+	}
+	return kvs
+}
+
+// otlpStringAttributes returns attrs as OTLP key/values, sorted by key.
+func otlpStringAttributes(attrs Attributes) []otlpKeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, k := range attrs.sortedKeys() {
+		kvs = append(kvs, otlpKeyValue{k, otlpValue(attrs[k])})
+	}
+	return kvs
+}
+
+// otlpValue returns v as an OTLP value. Unsigned integers too large for an int64 are sent as doubles, and values other
+// than strings, bools, integers, and floats are formatted as strings.
+func otlpValue(v interface{}) otlpAnyValue {
+	var i int64
+	switch v := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	case float32:
+		f := float64(v)
+		return otlpAnyValue{DoubleValue: &f}
+	case int:
+		i = int64(v)
+	case int8:
+		i = int64(v)
+	case int16:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint8:
+		i = int64(v)
+	case uint16:
+		i = int64(v)
+	case uint32:
+		i = int64(v)
+	case uint:
+		return otlpValue(uint64(v))
+	case uint64:
+		if v > math.MaxInt64 {
+			// Too large for an integer value, so send the nearest double, as for other values beyond int64.
+			f := float64(v)
+			return otlpAnyValue{DoubleValue: &f}
+		}
+		i = int64(v)
+	default:
+		s := fmt.Sprint(v)
+		return otlpAnyValue{StringValue: &s}
+	}
+	s := strconv.FormatInt(i, 10)
+	return otlpAnyValue{IntValue: &s}
+}
+
+func (e *OTLPExporter) post(ctx context.Context, payload otlpRequest) error {
+	var buf bytes.Buffer
+	err := compress(&buf, GzipCompression, 0, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(payload)
+	})
+	if err != nil {
+		return mkerr(ErrEncodingJSON, err)
+	}
+
+	url := e.URL
+	if url == "" {
+		url = OTLPEndpoint
+	}
+	req, err := http.NewRequest("POST", url, &buf)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	return statusError(resp)
+}
@@ -0,0 +1,150 @@
+package skunk
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOTLPValue(t *testing.T) {
+	str := func(s string) otlpAnyValue { return otlpAnyValue{StringValue: &s} }
+	integer := func(s string) otlpAnyValue { return otlpAnyValue{IntValue: &s} }
+	double := func(f float64) otlpAnyValue { return otlpAnyValue{DoubleValue: &f} }
+	yes := true
+
+	tests := []struct {
+		in   interface{}
+		want otlpAnyValue
+	}{
+		{"text", str("text")},
+		{true, otlpAnyValue{BoolValue: &yes}},
+		{1.5, double(1.5)},
+		{float32(0.5), double(0.5)},
+		{-7, integer("-7")},
+		{int8(-8), integer("-8")},
+		{int64(math.MinInt64), integer("-9223372036854775808")},
+		{uint8(8), integer("8")},
+		{uint32(math.MaxUint32), integer("4294967295")},
+		// Unsigned integers are integers too, as long as they fit in an int64.
+		{uint(9), integer("9")},
+		{uint64(math.MaxInt64), integer("9223372036854775807")},
+		{uint64(math.MaxUint64), double(math.MaxUint64)},
+		{time.Second, str("1s")},
+		{[]int{1}, str("[1]")},
+	}
+	for _, tt := range tests {
+		got, _ := json.Marshal(otlpValue(tt.in))
+		want, _ := json.Marshal(tt.want)
+		if string(got) != string(want) {
+			t.Errorf("otlpValue(%#v) = %s; want %s", tt.in, got, want)
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		zr, err := gzip.NewReader(r.Body)
+		if err == nil {
+			err = json.NewDecoder(zr).Decode(&req)
+		}
+		if err != nil || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- req
+	}))
+	defer srv.Close()
+
+	body := exporterBody(t)
+	route := Attributes{"route": "/index"}
+	sizes := NewHistogramMetric(10, 100).Add(5).Add(50).Add(500).Add(7)
+	body.Components[0].series = map[string]Series{
+		seriesKey("Component/Hits[hits]", route): {"Component/Hits[hits]", route, CounterMetric(2)},
+		seriesKey("Component/Size[By]", route):   {"Component/Size[By]", route, sizes},
+	}
+	e := &OTLPExporter{
+		URL:        srv.URL,
+		Headers:    map[string]string{"Authorization": "Bearer token"},
+		Attributes: map[string]interface{}{"service.name": "shop", "shard": uint64(3)},
+	}
+	if err := e.Export(context.Background(), body); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+
+	if len(req.ResourceMetrics) != 1 || len(req.ResourceMetrics[0].ScopeMetrics) != 1 {
+		t.Fatalf("got %+v; want one resource with one scope", req)
+	}
+	rm := req.ResourceMetrics[0]
+	resource := make(map[string]otlpAnyValue)
+	for _, kv := range rm.Resource.Attributes {
+		resource[kv.Key] = kv.Value
+	}
+	if v := resource["shard"].IntValue; v == nil || *v != "3" {
+		t.Errorf("shard = %+v; want int 3", resource["shard"])
+	}
+	if v := resource["host.name"].StringValue; v == nil || *v != "host" {
+		t.Errorf("host.name = %+v; want host", resource["host.name"])
+	}
+
+	sm := rm.ScopeMetrics[0]
+	if sm.Scope.Name != "web" {
+		t.Errorf("scope = %q; want web", sm.Scope.Name)
+	}
+
+	start := strconv.FormatInt(payloadTime.Add(-time.Minute).UnixNano(), 10)
+	end := strconv.FormatInt(payloadTime.UnixNano(), 10)
+	metrics := make(map[string]otlpMetric)
+	for _, m := range sm.Metrics {
+		metrics[m.Name] = m
+	}
+	if len(metrics) != len(sm.Metrics) || len(metrics) != 5 {
+		t.Fatalf("got metrics %+v; want 5 with distinct names", sm.Metrics)
+	}
+
+	// Counters are monotonic delta sums.
+	if m := metrics["Requests"]; m.Unit != "{requests}" || m.Sum == nil ||
+		m.Sum.AggregationTemporality != otlpDeltaTemporality || !m.Sum.IsMonotonic ||
+		!reflect.DeepEqual(m.Sum.DataPoints, []otlpNumberDataPoint{{nil, start, end, 12}}) {
+		t.Errorf("Requests = %+v", m)
+	}
+	if m := metrics["Hits"]; m.Sum == nil || len(m.Sum.DataPoints) != 1 ||
+		!reflect.DeepEqual(m.Sum.DataPoints[0].Attributes, otlpStringAttributes(route)) {
+		t.Errorf("Hits = %+v", m)
+	}
+
+	// Gauges have no temporality.
+	if m := metrics["CPU/Usage"]; m.Unit != "%" || m.Gauge == nil || m.Sum != nil ||
+		!reflect.DeepEqual(m.Gauge.DataPoints, []otlpNumberDataPoint{{nil, start, end, 42.5}}) {
+		t.Errorf("CPU/Usage = %+v", m)
+	}
+
+	// Ranges are delta histograms with a single bucket, and histograms keep their buckets.
+	if m := metrics["HTTP/index.html/Time"]; m.Unit != "ms" || m.Histogram == nil ||
+		m.Histogram.AggregationTemporality != otlpDeltaTemporality ||
+		!reflect.DeepEqual(m.Histogram.DataPoints, []otlpHistogramDataPoint{{
+			StartTimeUnixNano: start, TimeUnixNano: end,
+			Count: "3", Sum: 9, BucketCounts: []string{"3"}, Min: 1, Max: 6,
+		}}) {
+		t.Errorf("HTTP/index.html/Time = %+v", m)
+	}
+	if m := metrics["Size"]; m.Unit != "By" || m.Histogram == nil ||
+		m.Histogram.AggregationTemporality != otlpDeltaTemporality ||
+		!reflect.DeepEqual(m.Histogram.DataPoints, []otlpHistogramDataPoint{{
+			Attributes:        otlpStringAttributes(route),
+			StartTimeUnixNano: start, TimeUnixNano: end,
+			Count: "4", Sum: 562, BucketCounts: []string{"2", "1", "1"}, ExplicitBounds: []float64{10, 100},
+			Min: 5, Max: 500,
+		}}) {
+		t.Errorf("Size = %+v", m)
+	}
+}
@@ -72,6 +72,18 @@ type Component struct {
 	// nearest second. This is only used when constructing a payload using a copy of a Component.
 	Duration Seconds `json:"duration"`
 	Metrics  Metrics `json:"metrics"`
+	// Attributes describe the component to exporters that support dimensions. They're set with SetAttributes and
+	// aren't sent to NewRelic's plugin API.
+	Attributes Attributes `json:"-"`
+
+	// series holds the metrics recorded with attributes, keyed by seriesKey. In a snapshot, these are also flattened
+	// into Metrics, and plain holds the metrics recorded without attributes.
+	series map[string]Series
+	plain  Metrics
+
+	// account is the name of the agent account the component's metrics are sent to, as set by SetAccount. It's empty
+	// for the account of the agent's license key.
+	account string
 
 	// start is the time that the first metric was recorded. If start.IsZero is true, the time needs to be set to
 	// the current time once a metric is added. The start time is cleared upon an agent successfully sending
@@ -80,6 +92,10 @@ type Component struct {
 
 	// agent is a pointer to the Agent that owns this component.
 	agent *Agent
+
+	// collectors is the set of Collectors polled for this component each cycle. Access to this is controlled by the
+	// agent's runloop.
+	collectors []*componentCollector
 }
 
 // AddMetric adds a single metric to the Component. If the metric already exists by name in the Component, the value is
@@ -131,31 +147,142 @@ type Metric interface {
 	Merge(Metric) Metric
 }
 
+// Summarizer is implemented by Metrics that can describe their values as a Summary. All of the Metrics in this package
+// implement it, and metric log formats and exporters use it to describe metrics they don't otherwise know about. Metrics
+// that don't implement it are described by their JSON encoding instead.
+type Summarizer interface {
+	Summary() Summary
+}
+
+// summarize returns the Summary of m. If m doesn't implement Summarizer, it's summarized from its JSON encoding, which
+// NewRelic requires to be either a single number or an object with the fields of a RangeMetric. It returns false if m
+// can't be summarized. Metrics that can't be summarized are never sent, so every metric in a snapshot can be.
+func summarize(m Metric) (Summary, bool) {
+	if sm, ok := m.(Summarizer); ok {
+		return sm.Summary(), true
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil || string(b) == "null" {
+		return Summary{}, false
+	}
+	var f float64
+	if json.Unmarshal(b, &f) == nil {
+		return ScalarMetric(f).Summary(), true
+	}
+	var r RangeMetric
+	if json.Unmarshal(b, &r) == nil {
+		return r.Summary(), true
+	}
+	return Summary{}, false
+}
+
+// Summary holds the statistics describing the values recorded for a metric.
+type Summary struct {
+	Count int
+	Total float64
+	Min   float64
+	Max   float64
+	// SumOfSquares is the sum of the squares of all values recorded.
+	SumOfSquares float64
+	// SquaredDeviations is the sum of the squared differences between each value recorded and their mean. Variance
+	// is calculated from this rather than SumOfSquares, since doing so from SumOfSquares loses precision badly.
+	SquaredDeviations float64
+}
+
+// Mean returns the arithmetic mean of the values recorded. It returns 0 if no values were recorded.
+func (s Summary) Mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / float64(s.Count)
+}
+
+// Variance returns the population variance of the values recorded. It returns 0 if no values were recorded.
+func (s Summary) Variance() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.SquaredDeviations / float64(s.Count)
+}
+
+// StdDev returns the population standard deviation of the values recorded. It returns 0 if no values were recorded.
+func (s Summary) StdDev() float64 {
+	return math.Sqrt(s.Variance())
+}
+
 // ScalarMetric is any singular metric that does not cover a range a values. Adding to a ScalarMetric produces
 // a RangeMetric.
 type ScalarMetric float64
 
 func (s ScalarMetric) Add(value float64) Metric {
-	f := float64(s)
-	return RangeMetric{
-		Total:  f + value,
-		Count:  2,
-		Min:    math.Min(value, f),
-		Max:    math.Max(value, f),
-		Square: math.Pow(f, 2) + math.Pow(value, 2),
-	}
+	return rangeOf(float64(s)).Add(value)
 }
 
 func (s ScalarMetric) Merge(value Metric) Metric {
+	return value.Merge(rangeOf(float64(s)))
+}
+
+func (s ScalarMetric) Summary() Summary {
 	f := float64(s)
-	return value.Merge(RangeMetric{Total: f, Count: 1, Min: f, Max: f, Square: math.Pow(f, 2)})
+	return Summary{Count: 1, Total: f, Min: f, Max: f, SumOfSquares: f * f}
 }
 
 func (s ScalarMetric) MarshalJSON() ([]byte, error) {
 	return json.Marshal(float64(s))
 }
 
+// CounterMetric is a running total, such as the number of requests handled. Adding to or merging with a CounterMetric
+// adds to its total, so it's never turned into a RangeMetric. To NewRelic's plugin API, it's a single value, same as
+// a ScalarMetric, but exporters that distinguish kinds of metrics send it as a count.
+type CounterMetric float64
+
+func (c CounterMetric) Add(value float64) Metric {
+	return c + CounterMetric(value)
+}
+
+func (c CounterMetric) Merge(value Metric) Metric {
+	s, _ := summarize(value)
+	return c + CounterMetric(s.Total)
+}
+
+func (c CounterMetric) Summary() Summary {
+	return ScalarMetric(c).Summary()
+}
+
+// GaugeMetric is a value sampled at a point in time, such as the size of a queue. Adding to or merging with
+// a GaugeMetric replaces it with the newer value. To NewRelic's plugin API, it's a single value, same as
+// a ScalarMetric, but exporters that distinguish kinds of metrics send it as a gauge.
+//
+// Since merges keep the metric being merged in (see Metrics.AddMetric), a GaugeMetric should only be recorded under
+// names that never hold other kinds of metrics.
+type GaugeMetric float64
+
+func (g GaugeMetric) Add(value float64) Metric {
+	return GaugeMetric(value)
+}
+
+func (g GaugeMetric) Merge(Metric) Metric {
+	return g
+}
+
+func (g GaugeMetric) Summary() Summary {
+	return ScalarMetric(g).Summary()
+}
+
 // RangeMetric is any metric that covers a range of values. Adding to a RangeMetric produces a new RangeMetric.
+//
+// In addition to the fields sent to NewRelic, a RangeMetric built up through Add and Merge tracks its running mean and
+// sum of squared deviations from the mean (Welford's method). Variance calculated from those stays accurate where
+// subtracting Total²/Count from Square would lose everything to rounding, such as with large values that vary very
+// little. A RangeMetric built by hand has these derived from its other fields the first time it's added to.
+//
+// Because of this hidden state, two RangeMetrics with the same exported fields don't necessarily compare equal with ==
+// or reflect.DeepEqual: one built through Add won't equal the same literal. Compare their exported fields (or their
+// Summary) instead.
+//
+// A RangeMetric with a Count of zero is empty. Its other fields are ignored when it's added to or merged with, and
+// it's never sent to NewRelic.
 type RangeMetric struct {
 	Total float64 `json:"total"`
 	Count int     `json:"count"`
@@ -164,28 +291,104 @@ type RangeMetric struct {
 	// Square is the sum of squares of all values recorded for the metric. This is simply A₁² + A₂² + Aₙ² where A is
 	// the set of numbers recorded for this metric.
 	Square float64 `json:"sum_of_squares"`
+
+	// mean and m2 are the running mean and sum of squared deviations from the mean. They're only valid if tracked
+	// is true.
+	mean, m2 float64
+	tracked  bool
+}
+
+// rangeOf returns a RangeMetric holding the single value f.
+func rangeOf(f float64) RangeMetric {
+	return RangeMetric{Total: f, Count: 1, Min: f, Max: f, Square: f * f, mean: f, tracked: true}
+}
+
+// welford returns the running mean and sum of squared deviations of r. If r wasn't built through Add or Merge, these
+// are derived from Total and Square.
+func (r RangeMetric) welford() (mean, m2 float64) {
+	if r.tracked || r.Count == 0 {
+		return r.mean, r.m2
+	}
+	n := float64(r.Count)
+	mean = r.Total / n
+	if m2 = r.Square - r.Total*mean; m2 < 0 {
+		m2 = 0
+	}
+	return mean, m2
 }
 
 func (r RangeMetric) Add(value float64) Metric {
+	if r.Count == 0 {
+		// Like Min and Max, an empty range's Total and Square don't describe any value.
+		return rangeOf(value)
+	}
+
+	mean, m2 := r.welford()
+	n := float64(r.Count + 1)
+	delta := value - mean
+	mean += delta / n
+	m2 += delta * (value - mean)
+
 	return RangeMetric{
-		Total:  r.Total + value,
-		Count:  r.Count + 1,
-		Min:    math.Min(value, r.Min),
-		Max:    math.Max(value, r.Max),
-		Square: r.Square + math.Pow(value, 2),
+		Total:   r.Total + value,
+		Count:   r.Count + 1,
+		Min:     math.Min(value, r.Min),
+		Max:     math.Max(value, r.Max),
+		Square:  r.Square + math.Pow(value, 2),
+		mean:    mean,
+		m2:      m2,
+		tracked: true,
+	}
+}
+
+// Mean returns the arithmetic mean of the values recorded. It returns 0 if no values were recorded.
+func (r RangeMetric) Mean() float64 {
+	mean, _ := r.welford()
+	return mean
+}
+
+// Variance returns the population variance of the values recorded. It returns 0 if no values were recorded.
+func (r RangeMetric) Variance() float64 {
+	if r.Count == 0 {
+		return 0
 	}
+	_, m2 := r.welford()
+	return m2 / float64(r.Count)
+}
+
+// StdDev returns the population standard deviation of the values recorded. It returns 0 if no values were recorded.
+func (r RangeMetric) StdDev() float64 {
+	return math.Sqrt(r.Variance())
+}
+
+func (r RangeMetric) Summary() Summary {
+	_, m2 := r.welford()
+	return Summary{Count: r.Count, Total: r.Total, Min: r.Min, Max: r.Max, SumOfSquares: r.Square, SquaredDeviations: m2}
 }
 
 func (r RangeMetric) Merge(value Metric) Metric {
 	switch o := value.(type) {
 	case ScalarMetric:
-		f := float64(o)
-		r.Total += f
-		r.Count++
-		r.Min = math.Min(r.Min, f)
-		r.Max = math.Max(r.Max, f)
-		r.Square += math.Pow(f, 2)
+		return r.Add(float64(o))
 	case RangeMetric:
+		if o.Count == 0 {
+			return r
+		} else if r.Count == 0 {
+			return o
+		}
+
+		// Combine the running means and squared deviations of both (Chan et al.'s parallel variant of Welford's
+		// method).
+		ma, m2a := r.welford()
+		mb, m2b := o.welford()
+		na, nb := float64(r.Count), float64(o.Count)
+		if n := na + nb; n > 0 {
+			delta := mb - ma
+			r.mean = ma + delta*nb/n
+			r.m2 = m2a + m2b + delta*delta*na*nb/n
+		}
+		r.tracked = true
+
 		r.Total += o.Total
 		r.Count += o.Count
 		r.Min = math.Min(r.Min, o.Min)
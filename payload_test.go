@@ -0,0 +1,179 @@
+package skunk
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+// customMetric is a Metric implemented outside of the package's own, without a Summary method.
+type customMetric struct {
+	Value float64 `json:"-"`
+	JSON  string  `json:"-"`
+}
+
+func (m customMetric) Add(value float64) Metric {
+	return customMetric{Value: m.Value + value, JSON: m.JSON}
+}
+func (m customMetric) Merge(Metric) Metric { return m }
+func (m customMetric) MarshalJSON() ([]byte, error) {
+	return []byte(m.JSON), nil
+}
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		name string
+		m    Metric
+		want Summary
+		ok   bool
+	}{
+		{"scalar", ScalarMetric(2), Summary{Count: 1, Total: 2, Min: 2, Max: 2, SumOfSquares: 4}, true},
+		{"counter", CounterMetric(3), Summary{Count: 1, Total: 3, Min: 3, Max: 3, SumOfSquares: 9}, true},
+		{"custom number", customMetric{JSON: `4`}, Summary{Count: 1, Total: 4, Min: 4, Max: 4, SumOfSquares: 16}, true},
+		{
+			"custom range",
+			customMetric{JSON: `{"total":6,"count":2,"min":2,"max":4,"sum_of_squares":20}`},
+			Summary{Count: 2, Total: 6, Min: 2, Max: 4, SumOfSquares: 20, SquaredDeviations: 2},
+			true,
+		},
+		{"custom string", customMetric{JSON: `"six"`}, Summary{}, false},
+		{"custom null", customMetric{JSON: `null`}, Summary{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := summarize(tt.m)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("summarize() = %+v, %t; want %+v, %t", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFormatUnsummarizable(t *testing.T) {
+	com := &Component{Name: "app", GUID: "com.example.app", Metrics: Metrics{
+		"Component/Custom[things]": customMetric{JSON: `"six"`},
+	}}
+	for name, format := range map[string]MetricFormatter{
+		"table":  TableFormat,
+		"jsonl":  JSONLinesFormat,
+		"logfmt": LogfmtFormat,
+	} {
+		var buf bytes.Buffer
+		if err := format.FormatMetrics(&buf, []*Component{com}); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !strings.Contains(buf.String(), `six`) {
+			t.Errorf("%s: metric's JSON missing from %q", name, buf.String())
+		}
+	}
+}
+
+// twoPassVariance returns the population variance of values, computed from their mean in a second pass.
+func twoPassVariance(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+
+	var ss float64
+	for _, v := range values {
+		ss += (v - mean) * (v - mean)
+	}
+	return ss / float64(len(values))
+}
+
+func TestRangeMetricMergeVariance(t *testing.T) {
+	// shifted returns values with offset added to each.
+	shifted := func(offset float64, values ...float64) []float64 {
+		out := make([]float64, len(values))
+		for i, v := range values {
+			out[i] = offset + v
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		values []float64
+		// splits are the indices values are split at into ranges built separately and then merged.
+		splits []int
+	}{
+		{"small", []float64{4, 7, 13, 16}, []int{2}},
+		{"large offset", shifted(1e9, 4, 7, 13, 16), []int{2}},
+		{"larger offset", shifted(1e12, 4, 7, 13, 16, 2, 9), []int{1, 3}},
+		{"tiny values", []float64{4e-9, 7e-9, 13e-9, 16e-9}, []int{1}},
+		{"tiny spread", shifted(1, 1e-7, 2e-7, 3e-7, 4e-7, 5e-7), []int{2, 4}},
+		{"mixed magnitudes", []float64{1e-6, 1e6, 3e-6, 2e6, 5}, []int{2, 3}},
+		{"uneven halves", shifted(1e8, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10), []int{1}},
+		{"one per range", shifted(1e9, 1, 2, 3, 4), []int{1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var parts []Metric
+			prev := 0
+			for _, i := range append(tt.splits, len(tt.values)) {
+				var r Metric = RangeMetric{}
+				for _, v := range tt.values[prev:i] {
+					r = r.Add(v)
+				}
+				parts = append(parts, r)
+				prev = i
+			}
+
+			merged := parts[0]
+			for _, p := range parts[1:] {
+				merged = merged.Merge(p)
+			}
+
+			r := merged.(RangeMetric)
+			want := twoPassVariance(tt.values)
+			if r.Count != len(tt.values) {
+				t.Fatalf("Count = %d; want %d", r.Count, len(tt.values))
+			}
+			if got := r.Variance(); math.Abs(got-want) > 1e-9*want {
+				t.Errorf("Variance() = %v; want %v", got, want)
+			}
+			if s, _ := summarize(r); math.Abs(s.Variance()-want) > 1e-9*want {
+				t.Errorf("Summary().Variance() = %v; want %v", s.Variance(), want)
+			}
+		})
+	}
+}
+
+func TestRangeMetricMergeUntracked(t *testing.T) {
+	// Ranges built by hand, such as by another library, have their mean and squared deviations derived from their
+	// fields when merged.
+	a := RangeMetric{Total: 11, Count: 2, Min: 4, Max: 7, Square: 65}
+	b := RangeMetric{Total: 29, Count: 2, Min: 13, Max: 16, Square: 425}
+	r := a.Merge(b).(RangeMetric)
+
+	want := twoPassVariance([]float64{4, 7, 13, 16})
+	if got := r.Variance(); math.Abs(got-want) > 1e-12 {
+		t.Errorf("Variance() = %v; want %v", got, want)
+	}
+	if r.Total != 40 || r.Count != 4 || r.Min != 4 || r.Max != 16 || r.Square != 490 {
+		t.Errorf("merged = %+v", r)
+	}
+}
+
+func TestRangeMetricMergeEmpty(t *testing.T) {
+	r := RangeMetric{}.Add(1e9 + 4).Add(1e9 + 7)
+	for _, m := range []Metric{r.Merge(RangeMetric{}), RangeMetric{}.Merge(r)} {
+		if got := m.(RangeMetric); got.Count != 2 || got.Variance() != 2.25 {
+			t.Errorf("merged with empty = %+v (variance %v)", got, got.Variance())
+		}
+	}
+}
+
+func TestRangeMetricAddEmpty(t *testing.T) {
+	// An empty range's fields are ignored when it's added to, even if they're set.
+	stale := RangeMetric{Total: 100, Min: -5, Max: 50, Square: 1000}
+	got := stale.Add(3).(RangeMetric)
+	if want := rangeOf(3); got.Total != want.Total || got.Count != 1 || got.Min != 3 || got.Max != 3 ||
+		got.Square != want.Square || got.Mean() != 3 || got.Variance() != 0 {
+		t.Errorf("Add(3) = %+v; want %+v", got, want)
+	}
+}
@@ -0,0 +1,311 @@
+package skunk
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClockTicks is the number of clock ticks per second used by the kernel when reporting CPU times in /proc/<pid>/stat.
+// This is almost always 100 on Linux, but if you've got a kernel that says otherwise, you can change it here.
+var ClockTicks = 100
+
+// ProcessCollector reads process statistics out of procfs and produces metrics for them. It reports CPU usage (as
+// a percentage of one CPU since the last collection), resident set size, open file descriptors, thread count, and bytes
+// read and written since the last collection.
+//
+// Metrics are named Component/Process/<name>/<Metric>[<unit>], where name is the process's command name. Processes
+// that share a command name (e.g., worker processes matched by a pattern) are summed into the same metrics, so the RSS
+// of nginx is that of all of its processes together, and its CPU usage may exceed 100%. This keeps the number of
+// metrics bounded regardless of the number of processes matched.
+//
+// A ProcessCollector is safe for use by multiple goroutines.
+type ProcessCollector struct {
+	// Root is the mount point of procfs. If empty, /proc is used.
+	Root string
+	// PIDs is a list of process IDs to collect statistics for.
+	PIDs []int
+	// Names is a list of patterns to match against process command names, as understood by path.Match. Every
+	// process whose command name matches a pattern is included.
+	Names []string
+
+	mu   sync.Mutex
+	last map[int]procSample
+}
+
+// procSample is a snapshot of the counters of a process needed to calculate rates between collections.
+type procSample struct {
+	when                  time.Time
+	cpuTicks              uint64
+	readBytes, writeBytes uint64
+}
+
+// procStat is the set of statistics read from procfs for a single process.
+type procStat struct {
+	name     string
+	cpuTicks uint64
+	rss      uint64
+	threads  uint64
+	fds      uint64
+	read     uint64
+	written  uint64
+	hasIO    bool
+}
+
+// NewProcessCollector allocates a new ProcessCollector for the given PIDs. If no PIDs are given, the collector reports
+// on the current process.
+func NewProcessCollector(pids ...int) *ProcessCollector {
+	if len(pids) == 0 {
+		pids = []int{os.Getpid()}
+	}
+	return &ProcessCollector{PIDs: pids}
+}
+
+// NewProcessNameCollector allocates a new ProcessCollector for processes whose command names match any of the given
+// patterns.
+func NewProcessNameCollector(patterns ...string) *ProcessCollector {
+	return &ProcessCollector{Names: patterns}
+}
+
+func (p *ProcessCollector) root() string {
+	if p.Root == "" {
+		return "/proc"
+	}
+	return p.Root
+}
+
+// Collect reads the current statistics of all processes tracked by the collector and returns them as Metrics. If a PID
+// given explicitly cannot be read, metrics for all other processes are still returned along with the first error
+// encountered. Processes matched by name that disappear while being read are skipped. If ctx is done before all
+// processes are read, the metrics read so far are returned with ctx's error.
+func (p *ProcessCollector) Collect(ctx context.Context) (Metrics, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var firstErr error
+	now := time.Now()
+	sums := make(map[string]float64)
+	samples := make(map[int]procSample)
+
+	record := func(pid int, required bool) {
+		if _, ok := samples[pid]; ok || ctx.Err() != nil {
+			return
+		}
+
+		st, err := readProcStat(p.root(), pid)
+		if err != nil {
+			if required && firstErr == nil {
+				firstErr = mkerr(ErrReadingProc, err)
+			}
+			return
+		}
+
+		sample := procSample{when: now, cpuTicks: st.cpuTicks, readBytes: st.read, writeBytes: st.written}
+		samples[pid] = sample
+		st.addMetrics(sums, p.last[pid], sample)
+	}
+
+	for _, pid := range p.PIDs {
+		record(pid, true)
+	}
+
+	if len(p.Names) > 0 {
+		pids, err := matchProcNames(p.root(), p.Names)
+		if err != nil && firstErr == nil {
+			firstErr = mkerr(ErrReadingProc, err)
+		}
+		for _, pid := range pids {
+			record(pid, false)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		if firstErr == nil {
+			firstErr = err
+		}
+		// Processes that weren't reached keep their previous samples, so their next rates cover the time since then.
+		// Samples of processes that have exited are dropped on the next complete collection.
+		for pid, sample := range p.last {
+			if _, ok := samples[pid]; !ok {
+				samples[pid] = sample
+			}
+		}
+	}
+
+	p.last = samples
+	metrics := make(Metrics, len(sums))
+	for name, sum := range sums {
+		metrics[name] = ScalarMetric(sum)
+	}
+	return metrics, firstErr
+}
+
+// addMetrics adds the process's metrics to sums, which holds the totals of the processes sharing each metric. Rates
+// are only added if there's a previous sample to compare against.
+func (st *procStat) addMetrics(sums map[string]float64, prev, cur procSample) {
+	prefix := "Component/Process/" + st.name + "/"
+	sums[prefix+"Memory/RSS[bytes]"] += float64(st.rss)
+	sums[prefix+"Threads[threads]"] += float64(st.threads)
+	sums[prefix+"FileDescriptors[fds]"] += float64(st.fds)
+
+	if prev.when.IsZero() {
+		return
+	}
+
+	if elapsed := cur.when.Sub(prev.when).Seconds(); elapsed > 0 && cur.cpuTicks >= prev.cpuTicks {
+		cpu := float64(cur.cpuTicks-prev.cpuTicks) / float64(ClockTicks)
+		sums[prefix+"CPU[%]"] += cpu / elapsed * 100
+	}
+
+	if st.hasIO && cur.readBytes >= prev.readBytes && cur.writeBytes >= prev.writeBytes {
+		sums[prefix+"IO/Read[bytes]"] += float64(cur.readBytes - prev.readBytes)
+		sums[prefix+"IO/Write[bytes]"] += float64(cur.writeBytes - prev.writeBytes)
+	}
+}
+
+// readProcStat reads the stat, status, io, and fd entries for the given pid under root. The io file is frequently
+// unreadable for processes owned by other users, so failing to read it is not an error.
+func readProcStat(root string, pid int) (*procStat, error) {
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	st := new(procStat)
+
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+	if err = st.parseStat(stat); err != nil {
+		return nil, err
+	}
+
+	status, err := readKeyValues(filepath.Join(dir, "status"), ':')
+	if err != nil {
+		return nil, err
+	}
+	// VmRSS is missing for kernel threads, so treat it as zero.
+	if rss, ok := status["VmRSS"]; ok {
+		st.rss, _ = parseKiB(rss)
+	}
+	st.threads, _ = strconv.ParseUint(status["Threads"], 10, 64)
+
+	fds, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+	if err == nil {
+		st.fds = uint64(len(fds))
+	}
+
+	if io, err := readKeyValues(filepath.Join(dir, "io"), ':'); err == nil {
+		st.read, _ = strconv.ParseUint(io["read_bytes"], 10, 64)
+		st.written, _ = strconv.ParseUint(io["write_bytes"], 10, 64)
+		st.hasIO = true
+	}
+
+	return st, nil
+}
+
+// parseStat parses the contents of /proc/<pid>/stat. The command name is enclosed in parentheses and may itself contain
+// spaces and parentheses, so fields are only split after the last closing parenthesis.
+func (st *procStat) parseStat(b []byte) error {
+	open, end := bytes.IndexByte(b, '('), bytes.LastIndexByte(b, ')')
+	if open == -1 || end < open {
+		return mkerr(ErrMalformedProc, nil)
+	}
+	st.name = procName(string(b[open+1 : end]))
+
+	// Fields are numbered from 3 (state) onward here, per proc(5).
+	fields := strings.Fields(string(b[end+1:]))
+	if len(fields) < 22 {
+		return mkerr(ErrMalformedProc, nil)
+	}
+
+	utime, err := strconv.ParseUint(fields[14-3], 10, 64)
+	if err != nil {
+		return mkerr(ErrMalformedProc, err)
+	}
+	stime, err := strconv.ParseUint(fields[15-3], 10, 64)
+	if err != nil {
+		return mkerr(ErrMalformedProc, err)
+	}
+	st.cpuTicks = utime + stime
+
+	return nil
+}
+
+// procName sanitizes a process command name for use in a metric name.
+func procName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "unknown"
+	}
+	return strings.Replace(name, "/", "_", -1)
+}
+
+// matchProcNames scans root for process directories and returns the PIDs of all processes whose command name matches
+// one of patterns.
+func matchProcNames(root string, patterns []string) ([]int, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, ent := range entries {
+		pid, err := strconv.Atoi(ent.Name())
+		if err != nil || !ent.IsDir() {
+			continue
+		}
+
+		comm, err := ioutil.ReadFile(filepath.Join(root, ent.Name(), "comm"))
+		if err != nil {
+			// Likely exited between reading the directory and now.
+			continue
+		}
+
+		name := strings.TrimSpace(string(comm))
+		for _, pat := range patterns {
+			if ok, _ := path.Match(pat, name); ok {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids, nil
+}
+
+// readKeyValues reads a file of "key<sep> value" lines, as used by many procfs and cgroup files, into a map. Lines
+// without the separator are skipped.
+func readKeyValues(name string, sep byte) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kv := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if sep == ' ' {
+			line = strings.TrimSpace(line)
+		}
+		i := strings.IndexByte(line, sep)
+		if i == -1 {
+			continue
+		}
+		kv[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	return kv, scanner.Err()
+}
+
+// parseKiB parses a procfs size such as "1234 kB" and returns it in bytes.
+func parseKiB(s string) (uint64, error) {
+	s = strings.TrimSpace(strings.TrimSuffix(s, "kB"))
+	n, err := strconv.ParseUint(s, 10, 64)
+	return n * 1024, err
+}
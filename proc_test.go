@@ -0,0 +1,142 @@
+package skunk
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestProcessCollector(t *testing.T) {
+	tests := []struct {
+		name  string
+		pids  []int
+		names []string
+		want  map[string]float64
+	}{
+		{
+			name: "pid",
+			pids: []int{100},
+			want: map[string]float64{
+				"Component/Process/nginx/Memory/RSS[bytes]":    1024 * 1024,
+				"Component/Process/nginx/Threads[threads]":     2,
+				"Component/Process/nginx/FileDescriptors[fds]": 3,
+			},
+		},
+		{
+			// Processes sharing a name are summed.
+			name:  "shared name",
+			names: []string{"ngin?"},
+			want: map[string]float64{
+				"Component/Process/nginx/Memory/RSS[bytes]":    4096 * 1024,
+				"Component/Process/nginx/Threads[threads]":     6,
+				"Component/Process/nginx/FileDescriptors[fds]": 5,
+			},
+		},
+		{
+			// Command names may hold spaces and parentheses, and slashes are replaced. Kernel threads have no RSS
+			// or file descriptors.
+			name: "odd names",
+			pids: []int{200, 300},
+			want: map[string]float64{
+				"Component/Process/my (odd) proc)/Memory/RSS[bytes]":    512 * 1024,
+				"Component/Process/my (odd) proc)/Threads[threads]":     1,
+				"Component/Process/my (odd) proc)/FileDescriptors[fds]": 1,
+				"Component/Process/kworker_0:1/Memory/RSS[bytes]":       0,
+				"Component/Process/kworker_0:1/Threads[threads]":        1,
+				"Component/Process/kworker_0:1/FileDescriptors[fds]":    0,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProcessCollector{Root: "testdata/proc", PIDs: tt.pids, Names: tt.names}
+			metrics, err := p.Collect(context.Background())
+			if err != nil {
+				t.Fatalf("Collect() error = %v", err)
+			}
+			for name, m := range metrics {
+				if _, ok := m.(ScalarMetric); !ok {
+					t.Errorf("%s = %T; want a ScalarMetric", name, m)
+				}
+			}
+			checkMetrics(t, metrics, tt.want)
+		})
+	}
+}
+
+func TestProcessCollectorRates(t *testing.T) {
+	p := &ProcessCollector{Root: "testdata/proc", Names: []string{"nginx"}}
+	if _, err := p.Collect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend the previous samples were taken two seconds earlier, with fewer ticks and bytes.
+	for pid, s := range p.last {
+		s.when = s.when.Add(-2 * time.Second)
+		s.cpuTicks -= 100
+		s.readBytes -= 1024
+		p.last[pid] = s
+	}
+	metrics, err := p.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each process used a second of CPU time in about two seconds, so together they used about one CPU.
+	const cpu = "Component/Process/nginx/CPU[%]"
+	if v := float64(metrics[cpu].(ScalarMetric)); math.Abs(v-100) > 5 {
+		t.Errorf("%s = %v; want about 100", cpu, v)
+	}
+	delete(metrics, cpu)
+
+	checkMetrics(t, metrics, map[string]float64{
+		"Component/Process/nginx/Memory/RSS[bytes]":    4096 * 1024,
+		"Component/Process/nginx/Threads[threads]":     6,
+		"Component/Process/nginx/FileDescriptors[fds]": 5,
+		"Component/Process/nginx/IO/Read[bytes]":       2048,
+		"Component/Process/nginx/IO/Write[bytes]":      0,
+	})
+}
+
+func TestProcessCollectorMissingPID(t *testing.T) {
+	p := &ProcessCollector{Root: "testdata/proc", PIDs: []int{100, 999}}
+	metrics, err := p.Collect(context.Background())
+	if !iserr(err, ErrReadingProc) {
+		t.Errorf("Collect() error = %v; want ErrReadingProc", err)
+	}
+	if _, ok := metrics["Component/Process/nginx/Threads[threads]"]; !ok {
+		t.Error("metrics of readable PIDs missing")
+	}
+}
+
+func TestParseStat(t *testing.T) {
+	tests := []struct {
+		stat  string
+		name  string
+		ticks uint64
+		ok    bool
+	}{
+		{"1 (init) S 0 1 1 0 -1 4194560 1 0 0 0 7 3 0 0 20 0 1 0 1 1 1", "init", 10, true},
+		{"2 (a ) b) c) R 0 1 1 0 -1 4194560 1 0 0 0 1 2 0 0 20 0 1 0 1 1 1", "a ) b) c", 3, true},
+		{"3 (x/y) R 0 1 1 0 -1 4194560 1 0 0 0 1 2 0 0 20 0 1 0 1 1 1", "x_y", 3, true},
+		{"4 () R 0 1 1 0 -1 4194560 1 0 0 0 1 2 0 0 20 0 1 0 1 1 1", "unknown", 3, true},
+		{"5 (short) R 0 1", "", 0, false},
+		{"6 no parens R 0 1 1 0 -1 4194560 1 0 0 0 1 2 0 0 20 0 1 0 1 1 1", "", 0, false},
+		{"7 (bad) R 0 1 1 0 -1 4194560 1 0 0 0 x 2 0 0 20 0 1 0 1 1 1", "", 0, false},
+	}
+	for _, tt := range tests {
+		var st procStat
+		err := st.parseStat([]byte(tt.stat))
+		if !tt.ok {
+			if !iserr(err, ErrMalformedProc) {
+				t.Errorf("parseStat(%q) error = %v; want ErrMalformedProc", tt.stat, err)
+			}
+			continue
+		}
+		if err != nil || st.name != tt.name || st.cpuTicks != tt.ticks {
+			t.Errorf("parseStat(%q) = %q, %d, %v; want %q, %d", tt.stat, st.name, st.cpuTicks, err, tt.name, tt.ticks)
+		}
+	}
+}
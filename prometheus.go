@@ -0,0 +1,348 @@
+package skunk
+
+import (
+	"bufio"
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// PrometheusExporter is an http.Handler that renders an agent's metrics in the Prometheus text exposition format, so
+// the same instrumentation can be scraped by Prometheus.
+//
+// Since an agent clears its metrics after each send, a PrometheusExporter is also an Exporter: once added to the
+// agent's Exporters, it keeps running totals of the metrics sent so that counters, summaries, and histograms only ever
+// go up, as Prometheus expects. Each scrape renders those totals combined with the agent's unsent metrics. Without
+// being added to the agent's Exporters, it only renders the metrics recorded since the agent's last send.
+//
+// Metrics are rendered by kind:
+//
+//	CounterMetric          counter <name>_total
+//	GaugeMetric            gauge <name>
+//	ScalarMetric           gauge <name>
+//	HistogramMetric        histogram <name>_bucket, <name>_sum, and <name>_count
+//	RangeMetric and others summary <name>_sum and <name>_count, with gauges <name>_min and <name>_max
+//
+// Gauges hold the latest value sent, and the minimums and maximums of summaries are those of every value recorded.
+// A metric recorded as a ScalarMetric turns into a RangeMetric once a second value is recorded for it, so metrics that
+// should keep a single kind across scrapes should be recorded as one of the other kinds. Metrics with the same
+// Prometheus name but a different kind than the first rendered are skipped.
+//
+// Names are translated from NewRelic-style names by dropping the leading Component/ segment, converting segments to
+// snake case, joining them with underscores, and appending the unit (ms becomes milliseconds, s becomes seconds, and %
+// becomes percent) unless the name already ends with it. For example, Component/HTTP/index/ResponseTime[ms] becomes
+// http_index_response_time_milliseconds. Each series is labeled with its component's name and GUID (as component and
+// guid) and attributes, along with any attributes it was recorded with. Attributes whose label names are already taken
+// by those or by Prometheus itself (le and quantile) are prefixed with exported_, as Prometheus does for clashing
+// target labels, so component becomes exported_component.
+//
+// The handler responds with 503 Service Unavailable if the agent isn't running.
+type PrometheusExporter struct {
+	// Namespace, if set, is prepended to the name of every metric, followed by an underscore.
+	Namespace string
+
+	agent *Agent
+	// totals holds the running totals of metrics sent, keyed by component and series. It's only accessed from the
+	// agent's runloop.
+	totals map[string]promEntry
+}
+
+// promEntry is a single series held by a PrometheusExporter.
+type promEntry struct {
+	component, guid string
+	attrs           Attributes
+	series          Series
+}
+
+// NewPrometheusExporter returns a PrometheusExporter for the agent. To keep running totals of sent metrics, it must
+// also be added to the agent's Exporters before the agent is started.
+func NewPrometheusExporter(a *Agent) *PrometheusExporter {
+	return &PrometheusExporter{agent: a, totals: make(map[string]promEntry)}
+}
+
+// Export adds the metrics sent by the agent to the exporter's running totals. It must only be called by the agent
+// given to NewPrometheusExporter.
+func (e *PrometheusExporter) Export(_ context.Context, body *Body) error {
+	e.accumulate(e.totals, body)
+	return nil
+}
+
+// exportsInline makes the agent call Export from its runloop, where totals may be accessed, and in the same op that
+// clears the metrics exported, so that a scrape never sees them in neither or both of totals and unsent metrics.
+func (e *PrometheusExporter) exportsInline() {}
+
+// accumulate merges the metrics of body into entries. Gauges, including ScalarMetrics, replace any gauge already held.
+func (e *PrometheusExporter) accumulate(entries map[string]promEntry, body *Body) {
+	for _, com := range body.Components {
+		for _, s := range com.Series() {
+			key := com.Name + "\x00" + com.GUID + "\x00" + seriesKey(s.Name, s.Attributes)
+			if old, ok := entries[key]; ok && !(isGauge(s.Metric) && isGauge(old.series.Metric)) {
+				s.Metric = s.Metric.Merge(old.series.Metric)
+			}
+			entries[key] = promEntry{component: com.Name, guid: com.GUID, attrs: com.Attributes, series: s}
+		}
+	}
+}
+
+func isGauge(m Metric) bool {
+	switch m.(type) {
+	case ScalarMetric, GaugeMetric:
+		return true
+	}
+	return false
+}
+
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Gather the totals and unsent metrics in the runloop, so that a send can't happen between the two and count its
+	// metrics twice.
+	out := make(chan map[string]promEntry, 1)
+	ok := e.agent.tryOp(func(a *Agent) error {
+		entries := make(map[string]promEntry, len(e.totals))
+		for k, v := range e.totals {
+			entries[k] = v
+		}
+		e.accumulate(entries, a.snapshot(time.Now()))
+		out <- entries
+		return nil
+	})
+	if !ok {
+		http.Error(w, "skunk agent is not running", http.StatusServiceUnavailable)
+		return
+	}
+	entries := <-out
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	writePrometheus(bw, e.Namespace, entries)
+	bw.Flush()
+}
+
+// promFamily is a set of samples sharing a Prometheus metric name.
+type promFamily struct {
+	kind   string
+	series []promSeries
+}
+
+// promSeries is the sample lines of a single series in a family.
+type promSeries struct {
+	labels string
+	lines  []string
+}
+
+func writePrometheus(w *bufio.Writer, namespace string, entries map[string]promEntry) {
+	families := make(map[string]*promFamily)
+	add := func(name, kind, labels string, lines ...string) {
+		f, ok := families[name]
+		if !ok {
+			f = &promFamily{kind: kind}
+			families[name] = f
+		} else if f.kind != kind {
+			return
+		}
+		f.series = append(f.series, promSeries{labels, lines})
+	}
+
+	// Series whose names collide in a family of a different kind are dropped, so go through the entries in a fixed
+	// order to always keep the same ones.
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		ent := entries[k]
+		name := promName(namespace, ent.series.Name)
+		labels := promLabels(ent)
+		braced := "{" + labels + "}"
+
+		switch m := ent.series.Metric.(type) {
+		case CounterMetric:
+			name += "_total"
+			add(name, "counter", labels, name+braced+" "+promFloat(float64(m)))
+		case GaugeMetric:
+			add(name, "gauge", labels, name+braced+" "+promFloat(float64(m)))
+		case ScalarMetric:
+			add(name, "gauge", labels, name+braced+" "+promFloat(float64(m)))
+		case HistogramMetric:
+			counts := m.copyCounts()
+			lines := make([]string, 0, len(counts)+2)
+			var cumulative uint64
+			for i, n := range counts {
+				cumulative += n
+				le := math.Inf(1)
+				if i < len(m.Bounds) {
+					le = m.Bounds[i]
+				}
+				lines = append(lines, name+"_bucket{"+labels+`,le="`+promFloat(le)+`"} `+
+					strconv.FormatUint(cumulative, 10))
+			}
+			lines = append(lines,
+				name+"_sum"+braced+" "+promFloat(m.Total),
+				name+"_count"+braced+" "+strconv.Itoa(m.Count))
+			add(name, "histogram", labels, lines...)
+		default:
+			s, _ := summarize(m)
+			add(name, "summary", labels,
+				name+"_sum"+braced+" "+promFloat(s.Total),
+				name+"_count"+braced+" "+strconv.Itoa(s.Count))
+			add(name+"_min", "gauge", labels, name+"_min"+braced+" "+promFloat(s.Min))
+			add(name+"_max", "gauge", labels, name+"_max"+braced+" "+promFloat(s.Max))
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := families[name]
+		sort.Slice(f.series, func(i, j int) bool { return f.series[i].labels < f.series[j].labels })
+		w.WriteString("# TYPE " + name + " " + f.kind + "\n")
+		for _, s := range f.series {
+			for _, line := range s.lines {
+				w.WriteString(line)
+				w.WriteByte('\n')
+			}
+		}
+	}
+}
+
+// promLabels returns the labels of the entry, sorted by name, without enclosing braces. There's always at least the
+// component and guid labels.
+func promLabels(ent promEntry) string {
+	attrs := make(Attributes, len(ent.attrs)+len(ent.series.Attributes)+2)
+	for k, v := range ent.attrs {
+		attrs[promAttrLabel(k)] = v
+	}
+	for k, v := range ent.series.Attributes {
+		attrs[promAttrLabel(k)] = v
+	}
+	attrs["component"] = ent.component
+	attrs["guid"] = ent.guid
+
+	var b strings.Builder
+	for i, k := range attrs.sortedKeys() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(promLabelReplacer.Replace(attrs[k]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var promLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return formatFloat(f)
+}
+
+// promUnits maps NewRelic units to the names of units appended to Prometheus names.
+var promUnits = map[string]string{
+	"ms": "milliseconds",
+	"s":  "seconds",
+	"%":  "percent",
+}
+
+// promName translates a NewRelic-style metric name into a Prometheus metric name.
+func promName(namespace, name string) string {
+	base, unit := splitUnit(name)
+	base = strings.TrimPrefix(base, "Component/")
+
+	out := snakeCase(base)
+	if namespace != "" {
+		out = snakeCase(namespace) + "_" + out
+	}
+
+	if u, ok := promUnits[unit]; ok {
+		unit = u
+	} else {
+		unit = snakeCase(unit)
+	}
+	if unit != "" && out != unit && !strings.HasSuffix(out, "_"+unit) {
+		out += "_" + unit
+	}
+
+	if out == "" || (out[0] >= '0' && out[0] <= '9') {
+		out = "_" + out
+	}
+	return out
+}
+
+// promReservedLabels are the label names attributes can't use: those set for every series, and those Prometheus gives
+// meaning to in histograms and summaries.
+var promReservedLabels = map[string]bool{
+	"component": true,
+	"guid":      true,
+	"le":        true,
+	"quantile":  true,
+}
+
+// promAttrLabel returns the label name for the attribute key name, prefixing it with exported_ if it'd clash with a
+// reserved label.
+func promAttrLabel(name string) string {
+	if name = promLabelName(name); promReservedLabels[name] {
+		name = "exported_" + name
+	}
+	return name
+}
+
+// promLabelName returns name as a valid Prometheus label name.
+func promLabelName(name string) string {
+	name = snakeCase(name)
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// snakeCase converts s to lowercase snake case, with any runs of characters other than ASCII letters and digits
+// replaced by a single underscore. Word boundaries in camel case (e.g., ResponseTime or HTTPClient) are split with an
+// underscore too.
+func snakeCase(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	underscore := false
+	for i, r := range runes {
+		switch {
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			if unicode.IsUpper(r) && i > 0 && b.Len() > 0 && !underscore {
+				prev := runes[i-1]
+				next := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && next) {
+					b.WriteByte('_')
+				}
+			}
+			b.WriteRune(unicode.ToLower(r))
+			underscore = false
+		case b.Len() > 0 && !underscore:
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
@@ -0,0 +1,106 @@
+package skunk
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheusKindCollision(t *testing.T) {
+	// Both series are named queue_things, but one is a gauge and the other a summary. Only one kind can be written,
+	// and it must be the same every time.
+	entries := map[string]promEntry{
+		"a\x00Component/Queue[things]": {component: "a", guid: "com.example.a", series: Series{
+			Name:   "Component/Queue[things]",
+			Metric: GaugeMetric(1),
+		}},
+		"b\x00Component/Queue[things]": {component: "b", guid: "com.example.b", series: Series{
+			Name:   "Component/Queue[things]",
+			Metric: RangeMetric{}.Add(1).Add(2),
+		}},
+	}
+
+	var first string
+	for i := 0; i < 50; i++ {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		writePrometheus(w, "", entries)
+		w.Flush()
+
+		if i == 0 {
+			first = buf.String()
+			if !strings.Contains(first, "# TYPE queue_things gauge\n") {
+				t.Fatalf("want the gauge, sorted first, to win:\n%s", first)
+			}
+		} else if buf.String() != first {
+			t.Fatalf("output differs between writes:\n%s\nthen\n%s", first, buf.String())
+		}
+	}
+}
+
+func TestWritePrometheusReservedLabels(t *testing.T) {
+	// Attributes can't replace the component and guid labels or add an le label to histogram buckets.
+	entries := map[string]promEntry{
+		"a\x00Component/Latency[ms]": {
+			component: "a", guid: "com.example.a", attrs: Attributes{"Component": "other", "guid": "x"},
+			series: Series{
+				Name:       "Component/Latency[ms]",
+				Attributes: Attributes{"le": "5", "quantile": "0.5"},
+				Metric:     NewHistogramMetric(10).Add(1),
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writePrometheus(w, "", entries)
+	w.Flush()
+
+	labels := `component="a",exported_component="other",exported_guid="x",exported_le="5",exported_quantile="0.5",` +
+		`guid="com.example.a"`
+	for _, want := range []string{
+		"latency_milliseconds_bucket{" + labels + `,le="10"} 1` + "\n",
+		"latency_milliseconds_bucket{" + labels + `,le="+Inf"} 1` + "\n",
+		"latency_milliseconds_count{" + labels + "} 1\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestPrometheusExporterServeHTTP(t *testing.T) {
+	a := newTestAgent(t)
+	e := NewPrometheusExporter(a)
+	a.Exporters = []Exporter{e}
+
+	scrape := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec
+	}
+
+	if rec := scrape(); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("before Start: status = %d; want 503", rec.Code)
+	}
+
+	a.Start()
+	com, err := a.Component("app", "com.example.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	com.MergeMetric("Component/Requests[requests]", CounterMetric(3))
+	rec := scrape()
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(),
+		`requests_total{component="app",guid="com.example.app"} 3`) {
+		t.Errorf("status = %d, body:\n%s", rec.Code, rec.Body.String())
+	}
+
+	a.Close()
+	if rec := scrape(); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("after Close: status = %d; want 503", rec.Code)
+	}
+}
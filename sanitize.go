@@ -0,0 +1,130 @@
+package skunk
+
+import "math"
+
+// NonFinitePolicy controls what an agent does with metrics holding NaN or ±Inf values when building a payload. JSON
+// can't represent non-finite numbers, so without sanitizing them a single bad sample would fail the encoding of the
+// entire payload.
+type NonFinitePolicy int
+
+const (
+	// DropNonFinite drops metrics holding non-finite values from the payload. This is the default.
+	DropNonFinite NonFinitePolicy = iota
+	// ClampNonFinite replaces +Inf and -Inf with the largest and smallest finite float64 values, respectively, and
+	// NaN with zero.
+	ClampNonFinite
+	// ReportNonFinite drops metrics holding non-finite values, like DropNonFinite, and records the number dropped for
+	// each component as NonFiniteMetric. The agent also logs a warning for each component with dropped metrics.
+	ReportNonFinite
+)
+
+// NonFiniteMetric is the name of the metric counting metrics dropped for holding non-finite values under
+// ReportNonFinite. It's a CounterMetric, so exporters that distinguish counters report it as one.
+const NonFiniteMetric = "Component/Skunk/NonFinite[metrics]"
+
+// isFinite returns whether f is neither NaN nor ±Inf.
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// clampFinite returns f clamped to the range of finite float64 values, with NaN replaced by zero.
+func clampFinite(f float64) float64 {
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case math.IsInf(f, 1):
+		return math.MaxFloat64
+	case math.IsInf(f, -1):
+		return -math.MaxFloat64
+	}
+	return f
+}
+
+// finiteSummary returns whether all values of the summary are finite.
+func finiteSummary(s Summary) bool {
+	return isFinite(s.Total) && isFinite(s.Min) && isFinite(s.Max) && isFinite(s.SumOfSquares) &&
+		isFinite(s.SquaredDeviations)
+}
+
+// summaryRange returns a RangeMetric describing s.
+func summaryRange(s Summary) RangeMetric {
+	r := RangeMetric{
+		Total:   s.Total,
+		Count:   s.Count,
+		Min:     s.Min,
+		Max:     s.Max,
+		Square:  s.SumOfSquares,
+		m2:      s.SquaredDeviations,
+		tracked: true,
+	}
+	if s.Count > 0 {
+		r.mean = s.Total / float64(s.Count)
+	}
+	return r
+}
+
+// sanitizeMetric returns m as it should be sent to NewRelic according to policy, and whether it should be sent at all.
+// nonFinite is true if m holds non-finite values. Empty metrics (i.e., ranges with no values recorded) are never sent.
+func sanitizeMetric(policy NonFinitePolicy, m Metric) (sane Metric, ok, nonFinite bool) {
+	s, _ := summarize(m)
+	if s.Count == 0 {
+		return nil, false, false
+	} else if finiteSummary(s) {
+		return m, true, false
+	} else if policy != ClampNonFinite {
+		return nil, false, true
+	}
+
+	switch f := m.(type) {
+	case ScalarMetric:
+		return ScalarMetric(clampFinite(float64(f))), true, true
+	case CounterMetric:
+		return CounterMetric(clampFinite(float64(f))), true, true
+	case GaugeMetric:
+		return GaugeMetric(clampFinite(float64(f))), true, true
+	}
+
+	s.Total, s.Min, s.Max = clampFinite(s.Total), clampFinite(s.Min), clampFinite(s.Max)
+	s.SumOfSquares, s.SquaredDeviations = clampFinite(s.SumOfSquares), clampFinite(s.SquaredDeviations)
+	return summaryRange(s), true, true
+}
+
+// sanitizeMetrics removes or replaces metrics that can't be sent to NewRelic, according to policy, and returns the
+// number of non-finite metrics found. Empty metrics (i.e., ranges with no values recorded) are always dropped. metrics
+// is modified in place, so it must not be shared with the runloop.
+func sanitizeMetrics(policy NonFinitePolicy, metrics Metrics) (nonFinite int) {
+	for name, m := range metrics {
+		sane, ok, bad := sanitizeMetric(policy, m)
+		if bad {
+			nonFinite++
+		}
+		if !ok {
+			delete(metrics, name)
+		} else if bad {
+			metrics[name] = sane
+		}
+	}
+
+	if nonFinite > 0 && policy == ReportNonFinite {
+		metrics[NonFiniteMetric] = CounterMetric(nonFinite)
+	}
+	return nonFinite
+}
+
+// sanitizeSeries returns a copy of series with its metrics sanitized in the same way as sanitizeMetrics, except that
+// nothing is reported under ReportNonFinite. It returns nil if no series remain.
+func sanitizeSeries(policy NonFinitePolicy, series map[string]Series) map[string]Series {
+	var sane map[string]Series
+	for key, s := range series {
+		m, ok, _ := sanitizeMetric(policy, s.Metric)
+		if !ok {
+			continue
+		}
+		if sane == nil {
+			sane = make(map[string]Series, len(series))
+		}
+		s.Metric = m
+		sane[key] = s
+	}
+	return sane
+}
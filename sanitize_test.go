@@ -0,0 +1,76 @@
+package skunk
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNonFinitePayload(t *testing.T) {
+	tests := []struct {
+		policy NonFinitePolicy
+		want   map[string]interface{}
+	}{
+		{DropNonFinite, map[string]interface{}{
+			"Component/Finite[things]": 1.0,
+		}},
+		{ClampNonFinite, map[string]interface{}{
+			"Component/Finite[things]": 1.0,
+			"Component/NaN[things]":    0.0,
+			"Component/Inf[things]":    math.MaxFloat64,
+			"Component/Range[things]": map[string]interface{}{
+				"total": math.MaxFloat64, "count": 2.0, "min": 1.0, "max": math.MaxFloat64,
+				"sum_of_squares": math.MaxFloat64,
+			},
+		}},
+		{ReportNonFinite, map[string]interface{}{
+			"Component/Finite[things]": 1.0,
+			NonFiniteMetric:            3.0,
+		}},
+	}
+
+	for _, tt := range tests {
+		a := newTestAgent(t)
+		a.NonFinite = tt.policy
+		com := &Component{Name: "app", GUID: "com.example.app", agent: a, start: time.Now(), Metrics: Metrics{
+			"Component/Finite[things]": ScalarMetric(1),
+			"Component/NaN[things]":    ScalarMetric(math.NaN()),
+			"Component/Inf[things]":    GaugeMetric(math.Inf(1)),
+			"Component/Range[things]":  RangeMetric{}.Add(1).Add(math.Inf(1)),
+		}}
+		a.body.Components = []*Component{com}
+
+		// Payloads are only ever encoded from snapshots, which apply the policy.
+		var buf bytes.Buffer
+		now := time.Now()
+		snap := a.snapshot(now)
+		if m, ok := snap.Components[0].Metrics[NonFiniteMetric]; ok {
+			if _, ok := m.(CounterMetric); !ok {
+				t.Errorf("policy %d: %s = %T; want a CounterMetric", tt.policy, NonFiniteMetric, m)
+			}
+		}
+		if _, err := a.getPayload(&buf, snap, NoCompression); err != nil {
+			t.Fatalf("policy %d: getPayload() error = %v", tt.policy, err)
+		}
+
+		var payload struct {
+			Components []struct {
+				Metrics map[string]interface{} `json:"metrics"`
+			} `json:"components"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &payload); err != nil {
+			t.Fatalf("policy %d: invalid payload %s: %v", tt.policy, buf.String(), err)
+		}
+		if len(payload.Components) != 1 {
+			t.Fatalf("policy %d: got %d components; want 1", tt.policy, len(payload.Components))
+		}
+
+		got, _ := json.Marshal(payload.Components[0].Metrics)
+		want, _ := json.Marshal(tt.want)
+		if !bytes.Equal(got, want) {
+			t.Errorf("policy %d: metrics = %s; want %s", tt.policy, got, want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package skunk
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingExporter is an Exporter that keeps every body it's sent and signals each send on sent.
+type recordingExporter struct {
+	mu     sync.Mutex
+	bodies []*Body
+	sent   chan struct{}
+}
+
+func newRecordingExporter() *recordingExporter {
+	return &recordingExporter{sent: make(chan struct{}, 100)}
+}
+
+func (e *recordingExporter) Export(ctx context.Context, body *Body) error {
+	e.mu.Lock()
+	e.bodies = append(e.bodies, body)
+	e.mu.Unlock()
+	e.sent <- struct{}{}
+	return nil
+}
+
+// wait waits for the next send, failing t if none happens within timeout.
+func (e *recordingExporter) wait(t *testing.T, timeout time.Duration) *Body {
+	t.Helper()
+	select {
+	case <-e.sent:
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for export")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.bodies[len(e.bodies)-1]
+}
+
+// newTestAgent returns an agent that only sends to its exporters, with a quiet logger. It isn't started.
+func newTestAgent(t *testing.T, exporters ...Exporter) *Agent {
+	t.Helper()
+	a, err := NewWithRep("key", AgentRep{Host: "host", PID: 1, Version: "1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.DisablePluginAPI = true
+	a.Exporters = exporters
+	a.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	return a
+}
@@ -0,0 +1,566 @@
+package skunk
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// SQLFingerprintFunc reduces a query to a short name used in metric names. Fingerprints must come from a small, fixed
+// set of names (e.g., one per statement type and table) or the number of metrics a component holds grows without
+// bound.
+type SQLFingerprintFunc func(query string) string
+
+// SQLDriver wraps a database/sql driver and records metrics for the queries and statements executed through it into
+// a Component. For each query fingerprint, it records:
+//
+//	Component/SQL/<fingerprint>/Calls[calls]      -- one per query or exec
+//	Component/SQL/<fingerprint>/ResponseTime[ms]  -- time taken to run the query or exec
+//	Component/SQL/<fingerprint>/Rows[rows]        -- rows read from a query's results or affected by an exec
+//	Component/SQL/<fingerprint>/Errors[errors]    -- one per failed query or exec
+//
+// Committed and rolled back transactions are counted as Component/SQL/Tx/Commit[calls] and
+// Component/SQL/Tx/Rollback[calls]. A query's response time only covers the time until its first results are
+// available. Its row count is recorded once its rows are closed.
+//
+// A wrapped driver is used by registering it with database/sql:
+//
+//	sql.Register("skunk-postgres", skunk.WrapDriver(com, &pq.Driver{}))
+//	db, err := sql.Open("skunk-postgres", dsn)
+//
+// Or, for drivers that provide a driver.Connector, via WrapConnector and sql.OpenDB.
+type SQLDriver struct {
+	Driver    driver.Driver
+	Component *Component
+	// Fingerprint names queries in metric names. If nil, SQLFingerprint is used.
+	Fingerprint SQLFingerprintFunc
+}
+
+// WrapDriver returns an SQLDriver that records metrics for d into c.
+func WrapDriver(c *Component, d driver.Driver) *SQLDriver {
+	return &SQLDriver{Driver: d, Component: c}
+}
+
+// WrapConnector returns a driver.Connector that records metrics for connections opened by connector into c.
+func WrapConnector(c *Component, connector driver.Connector) driver.Connector {
+	d := WrapDriver(c, connector.Driver())
+	return &sqlConnector{Connector: connector, driver: d}
+}
+
+func (d *SQLDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{Conn: conn, driver: d}, nil
+}
+
+// OpenConnector implements driver.DriverContext. If the wrapped driver doesn't implement it, the returned Connector
+// opens connections with the wrapped driver's Open method.
+func (d *SQLDriver) OpenConnector(name string) (driver.Connector, error) {
+	if dc, ok := d.Driver.(driver.DriverContext); ok {
+		connector, err := dc.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &sqlConnector{Connector: connector, driver: d}, nil
+	}
+	return &sqlConnector{Connector: dsnConnector{name, d.Driver}, driver: d}, nil
+}
+
+func (d *SQLDriver) fingerprint(query string) string {
+	if d.Fingerprint != nil {
+		return d.Fingerprint(query)
+	}
+	return SQLFingerprint(query)
+}
+
+// record records a single query or exec under its fingerprint.
+func (d *SQLDriver) record(query string, elapsed time.Duration, err error) {
+	prefix := "Component/SQL/" + d.fingerprint(query) + "/"
+	metrics := Metrics{
+		prefix + "Calls[calls]":     ScalarMetric(1),
+		prefix + "ResponseTime[ms]": rangeOf(float64(elapsed) / float64(time.Millisecond)),
+	}
+	if err != nil {
+		metrics[prefix+"Errors[errors]"] = ScalarMetric(1)
+	}
+	d.Component.MergeMetrics(metrics)
+}
+
+// recordRows records the number of rows read or affected by a query.
+func (d *SQLDriver) recordRows(query string, rows int64) {
+	d.Component.MergeMetric("Component/SQL/"+d.fingerprint(query)+"/Rows[rows]", rangeOf(float64(rows)))
+}
+
+// recordExec records an exec and the number of rows it affected, if known.
+func (d *SQLDriver) recordExec(query string, start time.Time, res driver.Result, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	d.record(query, time.Since(start), err)
+	if err != nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil {
+		d.recordRows(query, n)
+	}
+}
+
+// recordQuery records a query and wraps its rows to record the number of rows read from them once closed.
+func (d *SQLDriver) recordQuery(query string, start time.Time, rows driver.Rows, err error) (driver.Rows, error) {
+	if err == driver.ErrSkip {
+		return nil, err
+	}
+	d.record(query, time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlRows{Rows: rows, driver: d, query: query}, nil
+}
+
+// dsnConnector is a driver.Connector for drivers that don't implement driver.DriverContext.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) { return c.driver.Open(c.dsn) }
+func (c dsnConnector) Driver() driver.Driver                        { return c.driver }
+
+// sqlConnector wraps a driver.Connector to wrap the connections it opens.
+type sqlConnector struct {
+	driver.Connector
+	driver *SQLDriver
+}
+
+func (c *sqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{Conn: conn, driver: c.driver}, nil
+}
+
+func (c *sqlConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// sqlConn wraps a driver.Conn. It implements all optional connection interfaces, falling back to the behavior
+// database/sql uses when the wrapped connection doesn't implement them.
+type sqlConn struct {
+	driver.Conn
+	driver *SQLDriver
+}
+
+func (c *sqlConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *sqlConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, query)
+	} else if err = ctx.Err(); err == nil {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStmt{Stmt: stmt, conn: c.Conn, driver: c.driver, query: query}, nil
+}
+
+func (c *sqlConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *sqlConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	var err error
+	if bt, ok := c.Conn.(driver.ConnBeginTx); ok {
+		tx, err = bt.BeginTx(ctx, opts)
+	} else if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) || opts.ReadOnly {
+		// Same restriction database/sql applies to drivers without BeginTx.
+		return nil, mkerr(ErrTxOptions, nil)
+	} else if err = ctx.Err(); err == nil {
+		tx, err = c.Conn.Begin()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{Tx: tx, driver: c.driver}, nil
+}
+
+func (c *sqlConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	var res driver.Result
+	var err error
+	start := time.Now()
+	switch ec := c.Conn.(type) {
+	case driver.ExecerContext:
+		res, err = ec.ExecContext(ctx, query, args)
+	case driver.Execer:
+		var vals []driver.Value
+		if vals, err = namedValuesToValues(args); err == nil {
+			res, err = ec.Exec(query, vals)
+		}
+	default:
+		// Makes database/sql prepare the statement instead, which is recorded by sqlStmt.
+		return nil, driver.ErrSkip
+	}
+	c.driver.recordExec(query, start, res, err)
+	return res, err
+}
+
+func (c *sqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	var err error
+	start := time.Now()
+	switch qc := c.Conn.(type) {
+	case driver.QueryerContext:
+		rows, err = qc.QueryContext(ctx, query, args)
+	case driver.Queryer:
+		var vals []driver.Value
+		if vals, err = namedValuesToValues(args); err == nil {
+			rows, err = qc.Query(query, vals)
+		}
+	default:
+		return nil, driver.ErrSkip
+	}
+	return c.driver.recordQuery(query, start, rows, err)
+}
+
+func (c *sqlConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *sqlConn) ResetSession(ctx context.Context) error {
+	if rs, ok := c.Conn.(driver.SessionResetter); ok {
+		return rs.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *sqlConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *sqlConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// sqlStmt wraps a prepared driver.Stmt. conn is the wrapped connection the statement was prepared on.
+type sqlStmt struct {
+	driver.Stmt
+	conn   driver.Conn
+	driver *SQLDriver
+	query  string
+}
+
+func (s *sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	start := time.Now()
+	res, err := s.Stmt.Exec(args)
+	s.driver.recordExec(s.query, start, res, err)
+	return res, err
+}
+
+func (s *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.Stmt.Query(args)
+	return s.driver.recordQuery(s.query, start, rows, err)
+}
+
+func (s *sqlStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	sc, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		vals, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		return s.Exec(vals)
+	}
+
+	start := time.Now()
+	res, err := sc.ExecContext(ctx, args)
+	s.driver.recordExec(s.query, start, res, err)
+	return res, err
+}
+
+func (s *sqlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	sc, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		vals, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		return s.Query(vals)
+	}
+
+	start := time.Now()
+	rows, err := sc.QueryContext(ctx, args)
+	return s.driver.recordQuery(s.query, start, rows, err)
+}
+
+// CheckNamedValue checks arguments the way database/sql would without the wrapper: with the statement's
+// NamedValueChecker if it has one, and otherwise its connection's. Since sqlStmt always implements NamedValueChecker,
+// database/sql never asks the connection itself.
+func (s *sqlStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	if nvc, ok := s.conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (s *sqlStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if cc, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return cc.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+// sqlTx wraps a driver.Tx to count commits and rollbacks.
+type sqlTx struct {
+	driver.Tx
+	driver *SQLDriver
+}
+
+func (tx *sqlTx) Commit() error {
+	err := tx.Tx.Commit()
+	if err == nil {
+		tx.driver.Component.MergeMetric("Component/SQL/Tx/Commit[calls]", ScalarMetric(1))
+	}
+	return err
+}
+
+func (tx *sqlTx) Rollback() error {
+	err := tx.Tx.Rollback()
+	if err == nil {
+		tx.driver.Component.MergeMetric("Component/SQL/Tx/Rollback[calls]", ScalarMetric(1))
+	}
+	return err
+}
+
+// sqlRows wraps driver.Rows to count the rows read. It implements the optional result set and column type interfaces,
+// falling back to the values database/sql uses when the wrapped rows don't implement them.
+type sqlRows struct {
+	driver.Rows
+	driver *SQLDriver
+	query  string
+	n      int64
+	once   sync.Once
+}
+
+func (r *sqlRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.n++
+	}
+	return err
+}
+
+func (r *sqlRows) Close() error {
+	r.once.Do(func() { r.driver.recordRows(r.query, r.n) })
+	return r.Rows.Close()
+}
+
+func (r *sqlRows) HasNextResultSet() bool {
+	if rs, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return rs.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *sqlRows) NextResultSet() error {
+	if rs, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return rs.NextResultSet()
+	}
+	return io.EOF
+}
+
+func (r *sqlRows) ColumnTypeScanType(idx int) reflect.Type {
+	if ct, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return ct.ColumnTypeScanType(idx)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *sqlRows) ColumnTypeDatabaseTypeName(idx int) string {
+	if ct, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return ct.ColumnTypeDatabaseTypeName(idx)
+	}
+	return ""
+}
+
+func (r *sqlRows) ColumnTypeLength(idx int) (int64, bool) {
+	if ct, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return ct.ColumnTypeLength(idx)
+	}
+	return 0, false
+}
+
+func (r *sqlRows) ColumnTypeNullable(idx int) (nullable, ok bool) {
+	if ct, ok := r.Rows.(driver.RowsColumnTypeNullable); ok {
+		return ct.ColumnTypeNullable(idx)
+	}
+	return false, false
+}
+
+func (r *sqlRows) ColumnTypePrecisionScale(idx int) (precision, scale int64, ok bool) {
+	if ct, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return ct.ColumnTypePrecisionScale(idx)
+	}
+	return 0, 0, false
+}
+
+// namedValuesToValues converts named values to plain values for drivers that predate named values.
+func namedValuesToValues(named []driver.NamedValue) ([]driver.Value, error) {
+	vals := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, mkerr(ErrNamedValues, nil)
+		}
+		vals[i] = nv.Value
+	}
+	return vals, nil
+}
+
+// sqlVerbs is the set of statement types SQLFingerprint names. Anything else is fingerprinted as "Other".
+var sqlVerbs = map[string]string{
+	"select":   "Select",
+	"insert":   "Insert",
+	"update":   "Update",
+	"delete":   "Delete",
+	"replace":  "Replace",
+	"merge":    "Merge",
+	"upsert":   "Upsert",
+	"with":     "With",
+	"call":     "Call",
+	"begin":    "Begin",
+	"commit":   "Commit",
+	"rollback": "Rollback",
+	"create":   "Create",
+	"alter":    "Alter",
+	"drop":     "Drop",
+	"truncate": "Truncate",
+}
+
+// SQLFingerprint is the default SQLFingerprintFunc. It names a query after its statement type and, for selects,
+// inserts, updates and deletes, the first table it refers to -- e.g., "SELECT * FROM public.users WHERE id = $1" is
+// fingerprinted as "Select/users". Statements it doesn't recognize are fingerprinted as "Other".
+func SQLFingerprint(query string) string {
+	words := strings.FieldsFunc(query, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '(' || r == ')' || r == ',' || r == ';'
+	})
+	if len(words) == 0 {
+		return "Other"
+	}
+
+	verb, ok := sqlVerbs[strings.ToLower(words[0])]
+	if !ok {
+		return "Other"
+	}
+
+	var after string
+	switch verb {
+	case "Select", "Delete":
+		after = "from"
+	case "Insert", "Replace":
+		after = "into"
+	case "Update":
+		if len(words) > 1 {
+			return verb + "/" + sqlTableName(words[1])
+		}
+		return verb
+	default:
+		return verb
+	}
+
+	for i, w := range words[:len(words)-1] {
+		if strings.EqualFold(w, after) {
+			return verb + "/" + sqlTableName(words[i+1])
+		}
+	}
+	return verb
+}
+
+// sqlTableName strips quoting and any schema from a table name and makes it safe for use in a metric name.
+func sqlTableName(name string) string {
+	name = strings.Trim(name, "`\"[]")
+	if i := strings.LastIndexByte(name, '.'); i != -1 {
+		name = strings.Trim(name[i+1:], "`\"[]")
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '[' || r == ']' || unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		return "unknown"
+	}
+	return name
+}
+
+// DBStatsCollector is a Collector that samples the connection pool statistics of a *sql.DB. It records:
+//
+//	Component/SQL/Pool/Open[connections]    -- open connections
+//	Component/SQL/Pool/InUse[connections]   -- connections in use
+//	Component/SQL/Pool/Idle[connections]    -- idle connections
+//	Component/SQL/Pool/Waits[waits]         -- connections waited for since the last collection
+//	Component/SQL/Pool/WaitTime[ms]         -- time spent waiting for connections since the last collection
+//	Component/SQL/Pool/Closed[connections]  -- connections closed due to pool limits since the last collection
+type DBStatsCollector struct {
+	DB *sql.DB
+
+	mu   sync.Mutex
+	last sql.DBStats
+}
+
+// NewDBStatsCollector returns a DBStatsCollector for db.
+func NewDBStatsCollector(db *sql.DB) *DBStatsCollector {
+	return &DBStatsCollector{DB: db}
+}
+
+func (c *DBStatsCollector) Collect(ctx context.Context) (Metrics, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := c.DB.Stats()
+	prev := c.last
+	c.last = st
+
+	closed := (st.MaxIdleClosed + st.MaxIdleTimeClosed + st.MaxLifetimeClosed) -
+		(prev.MaxIdleClosed + prev.MaxIdleTimeClosed + prev.MaxLifetimeClosed)
+	return Metrics{
+		"Component/SQL/Pool/Open[connections]":   ScalarMetric(st.OpenConnections),
+		"Component/SQL/Pool/InUse[connections]":  ScalarMetric(st.InUse),
+		"Component/SQL/Pool/Idle[connections]":   ScalarMetric(st.Idle),
+		"Component/SQL/Pool/Waits[waits]":        ScalarMetric(st.WaitCount - prev.WaitCount),
+		"Component/SQL/Pool/WaitTime[ms]":        ScalarMetric(float64(st.WaitDuration-prev.WaitDuration) / float64(time.Millisecond)),
+		"Component/SQL/Pool/Closed[connections]": ScalarMetric(closed),
+	}, nil
+}
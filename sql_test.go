@@ -0,0 +1,100 @@
+package skunk
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// testPoint is an argument type only testConn accepts, by way of its NamedValueChecker, like the custom types drivers
+// such as pgx accept.
+type testPoint struct{ x, y int }
+
+type testConnector struct{}
+
+func (testConnector) Connect(context.Context) (driver.Conn, error) { return &testConn{}, nil }
+func (testConnector) Driver() driver.Driver                        { return nil }
+
+// testConn is a driver.Conn whose statements record the arguments they're run with.
+type testConn struct {
+	args []driver.Value
+}
+
+func (c *testConn) Prepare(query string) (driver.Stmt, error) { return &testStmt{conn: c}, nil }
+func (c *testConn) Close() error                              { return nil }
+func (c *testConn) Begin() (driver.Tx, error)                 { return nil, driver.ErrSkip }
+
+func (c *testConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if p, ok := nv.Value.(testPoint); ok {
+		nv.Value = fmt.Sprintf("(%d,%d)", p.x, p.y)
+		return nil
+	}
+	return driver.ErrSkip
+}
+
+type testStmt struct {
+	conn *testConn
+}
+
+func (s *testStmt) Close() error  { return nil }
+func (s *testStmt) NumInput() int { return -1 }
+
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.args = args
+	return driver.RowsAffected(1), nil
+}
+
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.conn.args = args
+	return testRows{}, nil
+}
+
+type testRows struct{}
+
+func (testRows) Columns() []string              { return nil }
+func (testRows) Close() error                   { return nil }
+func (testRows) Next(dest []driver.Value) error { return io.EOF }
+
+func TestSQLStmtCheckNamedValue(t *testing.T) {
+	a := newTestAgent(t)
+	a.Start()
+	defer a.Close()
+	com, err := a.Component("db", "com.example.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := sql.OpenDB(WrapConnector(com, testConnector{}))
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Arguments to prepared statements must be checked by the wrapped connection's NamedValueChecker, as they would be
+	// without the wrapper.
+	stmt, err := conn.PrepareContext(context.Background(), "INSERT INTO points VALUES (?, ?)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(testPoint{1, 2}, 3); err != nil {
+		t.Fatalf("Exec() error = %v", err)
+	}
+
+	var args []driver.Value
+	conn.Raw(func(dc interface{}) error {
+		args = dc.(*sqlConn).Conn.(*testConn).args
+		return nil
+	})
+	if len(args) != 2 || args[0] != "(1,2)" || args[1] != int64(3) {
+		t.Errorf("statement got args %#v; want (1,2) and 3", args)
+	}
+}
@@ -0,0 +1,217 @@
+package skunk
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultStatsDPacketSize is the default maximum size of packets sent by a StatsDExporter. It keeps packets within
+// a single Ethernet frame.
+const DefaultStatsDPacketSize = 1432
+
+// StatsDExporter is an Exporter that sends metrics to a StatsD (or DogStatsD) server over UDP. Metrics are sent by kind:
+//
+//	CounterMetric            name:value|c
+//	GaugeMetric              name:value|g
+//	ScalarMetric             name:value|g
+//	RangeMetric and others   name:value|ms
+//
+// StatsD has no way to receive values already aggregated into a range, so a RangeMetric is sent as its minimum and
+// maximum followed by the mean of its remaining values with a sample rate of one over their count. This keeps the
+// count, minimum, and maximum of the metric intact. Etsy's StatsD only applies sample rates to a timer's count, so
+// its sum and mean are those of the three values sent; DogStatsD weights each value by its sample rate, so it also
+// keeps the sum intact. Other statistics, such as percentiles, aren't kept either way.
+//
+// Names are built from the metric's name with its unit and any leading Component/ segment removed and slashes replaced
+// by dots, prefixed by the component's name. For example, Component/HTTP/index/ResponseTime[ms] in the web component
+// is sent as web.HTTP.index.ResponseTime. Characters StatsD reserves (colons, pipes, at signs, and whitespace) and dots
+// within segments are replaced by underscores.
+//
+// If DogStatsD is set, the component's name isn't part of metric names. Instead, it's sent as the component tag, along
+// with the component's attributes and those of each metric, which aren't flattened into the metric's name.
+//
+// Lines are packed into packets of up to MaxPacketSize bytes. A line longer than that is sent in a packet of its own.
+type StatsDExporter struct {
+	// Addr is the address of the StatsD server, such as 127.0.0.1:8125.
+	Addr string
+	// Prefix, if set, is prepended to every metric name, followed by a dot.
+	Prefix string
+	// MaxPacketSize is the maximum size of packets sent. If zero or less, DefaultStatsDPacketSize is used.
+	MaxPacketSize int
+	// DogStatsD enables DogStatsD tags for components and attributes.
+	DogStatsD bool
+}
+
+// NewStatsDExporter returns a StatsDExporter sending to the StatsD server at addr.
+func NewStatsDExporter(addr string) *StatsDExporter {
+	return &StatsDExporter{Addr: addr}
+}
+
+func (e *StatsDExporter) Export(ctx context.Context, body *Body) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", e.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	size := e.MaxPacketSize
+	if size <= 0 {
+		size = DefaultStatsDPacketSize
+	}
+
+	var packet, line bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	emit := func(name, value, kind, rate, tags string) error {
+		line.Reset()
+		line.WriteString(name)
+		line.WriteByte(':')
+		line.WriteString(value)
+		line.WriteByte('|')
+		line.WriteString(kind)
+		if rate != "" {
+			line.WriteString("|@")
+			line.WriteString(rate)
+		}
+		if tags != "" {
+			line.WriteString("|#")
+			line.WriteString(tags)
+		}
+
+		if packet.Len() > 0 && packet.Len()+1+line.Len() > size {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.Write(line.Bytes())
+		return nil
+	}
+
+	for _, com := range body.Components {
+		if e.DogStatsD {
+			for _, s := range com.Series() {
+				tags := statsdTags(com, s.Attributes)
+				if err := e.writeMetric(emit, e.metricName("", s.Name), s.Metric, tags); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		for _, key := range sortedMetricNames(com) {
+			if err := e.writeMetric(emit, e.metricName(com.Name, key), com.Metrics[key], ""); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+type statsdEmitter func(name, value, kind, rate, tags string) error
+
+func (e *StatsDExporter) writeMetric(emit statsdEmitter, name string, m Metric, tags string) error {
+	switch m := m.(type) {
+	case CounterMetric:
+		return emit(name, statsdFloat(float64(m)), "c", "", tags)
+	case GaugeMetric:
+		return emitGauge(emit, name, float64(m), tags)
+	case ScalarMetric:
+		return emitGauge(emit, name, float64(m), tags)
+	}
+
+	s, _ := summarize(m)
+	if err := emit(name, statsdFloat(s.Min), "ms", "", tags); err != nil || s.Count == 1 {
+		return err
+	}
+	if err := emit(name, statsdFloat(s.Max), "ms", "", tags); err != nil || s.Count == 2 {
+		return err
+	}
+
+	rest := float64(s.Count - 2)
+	mean := (s.Total - s.Min - s.Max) / rest
+	return emit(name, statsdFloat(mean), "ms", statsdFloat(1/rest), tags)
+}
+
+// emitGauge emits a gauge. Since StatsD treats signed gauge values as changes to the gauge, a negative value is sent
+// by first setting the gauge to zero.
+func emitGauge(emit statsdEmitter, name string, value float64, tags string) error {
+	if value < 0 {
+		if err := emit(name, "0", "g", "", tags); err != nil {
+			return err
+		}
+	}
+	return emit(name, statsdFloat(value), "g", "", tags)
+}
+
+func statsdFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// statsdReplacer replaces characters that StatsD reserves, as well as dots, which separate segments of names.
+var statsdReplacer = strings.NewReplacer(
+	":", "_", "|", "_", "@", "_", "#", "_", ",", "_", ".", "_",
+	" ", "_", "\t", "_", "\n", "_", "\r", "_",
+)
+
+// metricName returns the StatsD name of a metric in the named component. If component is empty, it's left out.
+func (e *StatsDExporter) metricName(component, name string) string {
+	name, _ = splitUnit(name)
+	name = strings.TrimPrefix(name, "Component/")
+
+	var b strings.Builder
+	if e.Prefix != "" {
+		b.WriteString(e.Prefix)
+		b.WriteByte('.')
+	}
+	if component != "" {
+		b.WriteString(statsdReplacer.Replace(component))
+		b.WriteByte('.')
+	}
+	for i, seg := range strings.Split(name, "/") {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(statsdReplacer.Replace(seg))
+	}
+	return b.String()
+}
+
+// statsdTags returns the DogStatsD tags for a metric in the component, recorded with attrs.
+func statsdTags(com *Component, attrs Attributes) string {
+	all := make(Attributes, len(com.Attributes)+len(attrs)+1)
+	for k, v := range com.Attributes {
+		all[k] = v
+	}
+	for k, v := range attrs {
+		all[k] = v
+	}
+	all["component"] = com.Name
+
+	var b strings.Builder
+	for i, k := range all.sortedKeys() {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		// Colons separate tag names from values, so they can't appear in names.
+		b.WriteString(strings.Replace(statsdTagReplacer.Replace(k), ":", "_", -1))
+		b.WriteByte(':')
+		b.WriteString(statsdTagReplacer.Replace(all[k]))
+	}
+	return b.String()
+}
+
+// statsdTagReplacer replaces characters that can't appear in DogStatsD tags. Colons are allowed in tag values.
+var statsdTagReplacer = strings.NewReplacer("|", "_", "#", "_", ",", "_", " ", "_", "\n", "_", "\r", "_", "\t", "_")
@@ -0,0 +1,134 @@
+package skunk
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenStatsD starts a local UDP listener standing in for a StatsD server. Each packet it receives is sent on the
+// returned channel.
+func listenStatsD(t *testing.T) (addr string, packets <-chan string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ch := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				close(ch)
+				return
+			}
+			ch <- string(buf[:n])
+		}
+	}()
+	return conn.LocalAddr().String(), ch
+}
+
+// receiveStatsD returns the packets received until none arrive for a short while.
+func receiveStatsD(t *testing.T, packets <-chan string) []string {
+	var got []string
+	timeout := 5 * time.Second
+	for {
+		select {
+		case p := <-packets:
+			got = append(got, p)
+			timeout = 100 * time.Millisecond
+		case <-time.After(timeout):
+			if len(got) == 0 {
+				t.Fatal("timed out waiting for packets")
+			}
+			return got
+		}
+	}
+}
+
+func statsdBody(t *testing.T) *Body {
+	return snapshotOf(t, &Body{
+		Agent: AgentRep{Host: "host", Version: "1.0"},
+		Components: []*Component{{
+			Name: "web", GUID: "com.example.web", Attributes: Attributes{"env": "prod"},
+			start: payloadTime.Add(-time.Minute),
+			Metrics: Metrics{
+				"Component/Requests[requests]":         CounterMetric(12),
+				"Component/Queue[jobs]":                GaugeMetric(-2),
+				"Component/HTTP/index/Latency[ms]":     RangeMetric{}.Add(1).Add(2).Add(3).Add(6),
+				"Component/HTTP/one.value/Size[bytes]": RangeMetric{}.Add(5),
+			},
+		}},
+	})
+}
+
+func TestStatsDExporter(t *testing.T) {
+	addr, packets := listenStatsD(t)
+	e := NewStatsDExporter(addr)
+	e.Prefix = "skunk"
+	if err := e.Export(context.Background(), statsdBody(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Split(strings.Join(receiveStatsD(t, packets), "\n"), "\n")
+	want := []string{
+		// Ranges are sent as their minimum, maximum, and the mean of the rest with a sample rate of one over their
+		// count.
+		"skunk.web.HTTP.index.Latency:1|ms",
+		"skunk.web.HTTP.index.Latency:6|ms",
+		"skunk.web.HTTP.index.Latency:2.5|ms|@0.5",
+		"skunk.web.HTTP.one_value.Size:5|ms",
+		// Negative gauges are set to zero first, since signed values are changes.
+		"skunk.web.Queue:0|g",
+		"skunk.web.Queue:-2|g",
+		"skunk.web.Requests:12|c",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("received:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestStatsDExporterDogStatsD(t *testing.T) {
+	addr, packets := listenStatsD(t)
+	e := &StatsDExporter{Addr: addr, DogStatsD: true}
+	if err := e.Export(context.Background(), statsdBody(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(strings.Join(receiveStatsD(t, packets), "\n"), "\n") {
+		if !strings.HasSuffix(line, "|#component:web,env:prod") {
+			t.Errorf("line %q missing component and attribute tags", line)
+		}
+		if strings.HasPrefix(line, "web.") {
+			t.Errorf("line %q has the component in its name", line)
+		}
+	}
+}
+
+func TestStatsDExporterPacketSize(t *testing.T) {
+	addr, packets := listenStatsD(t)
+	e := &StatsDExporter{Addr: addr, Prefix: "skunk", MaxPacketSize: 64}
+	if err := e.Export(context.Background(), statsdBody(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := receiveStatsD(t, packets)
+	if len(got) < 2 {
+		t.Errorf("got %d packets; want lines split across several", len(got))
+	}
+	lines := 0
+	for _, p := range got {
+		if len(p) > e.MaxPacketSize {
+			t.Errorf("packet of %d bytes exceeds %d: %q", len(p), e.MaxPacketSize, p)
+		}
+		lines += strings.Count(p, "\n") + 1
+	}
+	if lines != 7 {
+		t.Errorf("got %d lines; want 7", lines)
+	}
+}
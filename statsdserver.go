@@ -0,0 +1,463 @@
+package skunk
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxStatsDPacket is the size of the buffer StatsDServer reads packets into. It's the largest UDP payload possible.
+const maxStatsDPacket = 65535
+
+// DefaultStatsDMaxGauges is the default number of gauges a StatsDServer holds the last value of.
+const DefaultStatsDMaxGauges = 10000
+
+// StatsDServer receives metrics sent in the StatsD protocol, over UDP or TCP, and records them in an agent's
+// components. This lets processes that can't use skunk directly report through it, with skunk acting as a local
+// aggregator.
+//
+// Each line received is a single metric of the form name:value|type, optionally followed by a sample rate (|@rate) and
+// DogStatsD tags (|#key:value,...). Lines are recorded by type:
+//
+//	c    CounterMetric of value divided by the sample rate
+//	ms   value added to a RangeMetric
+//	h    value added to a RangeMetric
+//	g    GaugeMetric of value, or of the last value received plus value if value is signed with + or -
+//
+// Metrics received are buffered and merged into their components from a separate goroutine, so reading never waits on
+// the agent. Metrics received while a merge is in progress are merged with each other and recorded by the next one.
+//
+// To NewRelic's plugin API, counters and gauges are single values, same as a ScalarMetric. Timers and histograms
+// aren't scaled by their sample rate, since a RangeMetric can't weight its values. Other types, such as sets, are
+// malformed lines.
+//
+// The first dot-separated segment of each name picks the component it's recorded in from Components, and is removed
+// from the name. If no component matches, the metric is recorded in Component, or dropped if that's nil. The rest of
+// the name has its dots replaced by slashes and is prefixed by Component/ and followed by a unit (count for counters,
+// ms for timers, and value for everything else). For example, with a Components entry for web, web.http.requests:1|c
+// is recorded as Component/http/requests[count] in that component. This is the reverse of the names sent by
+// a StatsDExporter, less units. Tags are recorded as the metric's attributes, and tags without a value have an empty
+// attribute value.
+//
+// Components and MaxGauges must not be modified once the server is serving.
+type StatsDServer struct {
+	// Component receives metrics that don't match any of Components. If nil, those metrics are dropped.
+	Component *Component
+	// Components maps the first segment of metric names to the components they're recorded in.
+	Components map[string]*Component
+	// Logger, if set, receives warnings about malformed lines.
+	Logger *slog.Logger
+	// MaxGauges is the maximum number of gauges whose last value is held, so that signed values can be applied to it
+	// as changes. Once reached, signed values for other gauges are applied to zero. If zero or less,
+	// DefaultStatsDMaxGauges is used.
+	MaxGauges int
+
+	mu     sync.Mutex
+	closed bool
+	// stopped is set once everything served has finished recording after Close, so the merge goroutine knows no more
+	// metrics can arrive. closed is too early for that, since what's being served may still be recording.
+	stopped bool
+	closers map[io.Closer]struct{}
+	// serving counts what's being served, so that Close can wait for everything read to be recorded.
+	serving sync.WaitGroup
+	// gauges holds the last value of each gauge received, so that signed gauge values can be applied as changes.
+	gauges map[statsdGauge]float64
+
+	// pending holds the metrics received but not yet merged into their components. signal is sent on, without
+	// blocking, when there are pending metrics or the server is closing, and done is closed once the goroutine merging
+	// them has made its final merge and exited. Both are nil until the server starts serving.
+	pending map[*Component]*statsdBatch
+	signal  chan struct{}
+	done    chan struct{}
+}
+
+// statsdBatch is the metrics received for a component between merges.
+type statsdBatch struct {
+	metrics Metrics
+	// series holds metrics received with tags, by seriesKey.
+	series map[string]Series
+}
+
+type statsdGauge struct {
+	com *Component
+	key string
+}
+
+// NewStatsDServer returns a StatsDServer recording metrics in com.
+func NewStatsDServer(com *Component) *StatsDServer {
+	return &StatsDServer{Component: com}
+}
+
+// ServePacket reads packets of newline-separated lines from conn and records them until conn is closed. If conn is
+// closed by Close, it returns nil. Otherwise, it returns the error that ended reading.
+func (s *StatsDServer) ServePacket(conn net.PacketConn) error {
+	if !s.track(conn) {
+		return nil
+	}
+	defer s.untrack(conn)
+
+	buf := make([]byte, maxStatsDPacket)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if n > 0 {
+			s.record(strings.Split(string(buf[:n]), "\n"))
+		}
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// Serve accepts connections from l and records the lines read from each until the connection is closed. If l is closed
+// by Close, it returns nil. Otherwise, it returns the error that ended accepting connections.
+func (s *StatsDServer) Serve(l net.Listener) error {
+	if !s.track(l) {
+		return nil
+	}
+	defer s.untrack(l)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *StatsDServer) serveConn(conn net.Conn) {
+	if !s.track(conn) {
+		return
+	}
+	defer s.untrack(conn)
+
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 4096), maxStatsDPacket)
+	for sc.Scan() {
+		s.record([]string{sc.Text()})
+	}
+}
+
+// Close stops the server, closing every packet conn, listener, and connection it's serving, and waits for the metrics
+// already received to be merged into their components. Subsequent calls to Serve and ServePacket close what they're
+// given and return immediately. The agent must still be running.
+func (s *StatsDServer) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	closers := s.closers
+	s.closers = nil
+	done := s.done
+	s.mu.Unlock()
+
+	var first error
+	for c := range closers {
+		if err := c.Close(); err != nil && first == nil && !errors.Is(err, net.ErrClosed) {
+			first = err
+		}
+	}
+
+	s.serving.Wait()
+	if done != nil {
+		s.mu.Lock()
+		s.stopped = true
+		s.mu.Unlock()
+		s.notify()
+		<-done
+	}
+	return first
+}
+
+// track adds c to the set of things closed by Close, starting the goroutine merging metrics if it isn't running yet.
+// If the server is already closed, it closes c and returns false.
+func (s *StatsDServer) track(c io.Closer) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		c.Close()
+		return false
+	}
+	if s.closers == nil {
+		s.closers = make(map[io.Closer]struct{})
+	}
+	s.closers[c] = struct{}{}
+	s.serving.Add(1)
+	if s.done == nil {
+		s.signal = make(chan struct{}, 1)
+		s.done = make(chan struct{})
+		go s.merge()
+	}
+	s.mu.Unlock()
+	return true
+}
+
+func (s *StatsDServer) untrack(c io.Closer) {
+	s.mu.Lock()
+	delete(s.closers, c)
+	s.mu.Unlock()
+	c.Close()
+	s.serving.Done()
+}
+
+func (s *StatsDServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *StatsDServer) logWarn(msg string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Warn(msg, args...)
+	}
+}
+
+// statsdLine is a single parsed StatsD line.
+type statsdLine struct {
+	name  string
+	value float64
+	kind  string
+	rate  float64
+	// delta is set for gauges with a signed value.
+	delta bool
+	attrs Attributes
+}
+
+// record parses lines and adds them to the metrics waiting to be merged.
+func (s *StatsDServer) record(lines []string) {
+	var batches map[*Component]*statsdBatch
+	for _, raw := range lines {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		line, err := parseStatsDLine(raw)
+		if err != nil {
+			s.logWarn("skunk: dropped StatsD line", "error", err)
+			continue
+		}
+
+		com, name := s.route(line)
+		if com == nil {
+			continue
+		}
+
+		var m Metric
+		switch line.kind {
+		case "c":
+			m = CounterMetric(line.value / line.rate)
+		case "ms", "h":
+			m = ScalarMetric(line.value)
+		case "g":
+			m = GaugeMetric(s.gauge(com, seriesKey(name, line.attrs), line.value, line.delta))
+		}
+
+		if batches == nil {
+			batches = make(map[*Component]*statsdBatch)
+		}
+		b := batches[com]
+		if b == nil {
+			b = &statsdBatch{}
+			batches[com] = b
+		}
+		b.add(name, m, line.attrs)
+	}
+	if len(batches) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	if s.pending == nil {
+		s.pending, batches = batches, nil
+	}
+	for com, b := range batches {
+		if p := s.pending[com]; p != nil {
+			p.merge(b)
+		} else {
+			s.pending[com] = b
+		}
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *StatsDServer) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// merge merges pending metrics into their components as they're received, until the server is closed and everything
+// it was serving has stopped.
+func (s *StatsDServer) merge() {
+	defer close(s.done)
+	for range s.signal {
+		s.mu.Lock()
+		pending, stopped := s.pending, s.stopped
+		s.pending = nil
+		s.mu.Unlock()
+
+		for com, b := range pending {
+			if len(b.metrics) > 0 {
+				com.MergeMetrics(b.metrics)
+			}
+			for _, series := range b.series {
+				com.MergeAttributedMetric(series.Name, series.Metric, series.Attributes)
+			}
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// add adds a metric, received with attrs, to the batch.
+func (b *statsdBatch) add(name string, m Metric, attrs Attributes) {
+	if len(attrs) == 0 {
+		if b.metrics == nil {
+			b.metrics = make(Metrics)
+		}
+		b.metrics.AddMetric(name, m)
+		return
+	}
+
+	if b.series == nil {
+		b.series = make(map[string]Series)
+	}
+	key := seriesKey(name, attrs)
+	if old, ok := b.series[key]; ok {
+		m = m.Merge(old.Metric)
+	}
+	b.series[key] = Series{Name: name, Attributes: attrs, Metric: m}
+}
+
+// merge merges the metrics of newer into the batch.
+func (b *statsdBatch) merge(newer *statsdBatch) {
+	for name, m := range newer.metrics {
+		b.add(name, m, nil)
+	}
+	for _, series := range newer.series {
+		b.add(series.Name, series.Metric, series.Attributes)
+	}
+}
+
+// statsdUnits maps StatsD types to the units of the metrics they're recorded as.
+var statsdUnits = map[string]string{
+	"c":  "count",
+	"ms": "ms",
+	"h":  "value",
+	"g":  "value",
+}
+
+// route returns the component a line is recorded in and the name it's recorded under. The component is nil if the
+// line is dropped.
+func (s *StatsDServer) route(line statsdLine) (*Component, string) {
+	com, name := s.Component, line.name
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if c, ok := s.Components[name[:i]]; ok {
+			com, name = c, name[i+1:]
+		}
+	} else if c, ok := s.Components[name]; ok {
+		com = c
+	}
+	if com == nil {
+		return nil, ""
+	}
+	name = strings.Replace(statsdNameReplacer.Replace(name), ".", "/", -1)
+	return com, "Component/" + name + "[" + statsdUnits[line.kind] + "]"
+}
+
+// statsdNameReplacer replaces characters in StatsD names that would otherwise introduce segments or units.
+var statsdNameReplacer = strings.NewReplacer("/", "_", "[", "_", "]", "_")
+
+// gauge returns the value of a gauge after receiving value, updating the last value held for it.
+func (s *StatsDServer) gauge(com *Component, key string, value float64, delta bool) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.gauges == nil {
+		s.gauges = make(map[statsdGauge]float64)
+	}
+	k := statsdGauge{com, key}
+	last, ok := s.gauges[k]
+	if delta {
+		value += last
+	}
+
+	limit := s.MaxGauges
+	if limit <= 0 {
+		limit = DefaultStatsDMaxGauges
+	}
+	if ok || len(s.gauges) < limit {
+		s.gauges[k] = value
+	}
+	return value
+}
+
+// parseStatsDLine parses a single StatsD line. Errors returned are ErrMalformedStatsD errors.
+func parseStatsDLine(raw string) (line statsdLine, err error) {
+	malformed := func(why string) (statsdLine, error) {
+		return statsdLine{}, mkerr(ErrMalformedStatsD, fmt.Errorf("%q: %s", raw, why))
+	}
+
+	pipe := strings.IndexByte(raw, '|')
+	if pipe == -1 {
+		return malformed("missing type")
+	}
+	colon := strings.LastIndexByte(raw[:pipe], ':')
+	if colon <= 0 {
+		return malformed("missing name")
+	}
+	line.name = raw[:colon]
+
+	value := raw[colon+1 : pipe]
+	fields := strings.Split(raw[pipe+1:], "|")
+	line.kind, line.rate = fields[0], 1
+	if _, ok := statsdUnits[line.kind]; !ok {
+		return malformed("unsupported type " + strconv.Quote(line.kind))
+	}
+
+	line.delta = line.kind == "g" && value != "" && (value[0] == '+' || value[0] == '-')
+	if line.value, err = strconv.ParseFloat(value, 64); err != nil || math.IsInf(line.value, 0) ||
+		math.IsNaN(line.value) {
+		return malformed("invalid value")
+	}
+
+	for _, f := range fields[1:] {
+		switch {
+		case strings.HasPrefix(f, "@"):
+			rate, err := strconv.ParseFloat(f[1:], 64)
+			if err != nil || !(rate > 0 && rate <= 1) {
+				return malformed("invalid sample rate")
+			}
+			line.rate = rate
+		case strings.HasPrefix(f, "#"):
+			for _, tag := range strings.Split(f[1:], ",") {
+				if tag == "" {
+					continue
+				}
+				if line.attrs == nil {
+					line.attrs = make(Attributes)
+				}
+				k, v, _ := strings.Cut(tag, ":")
+				line.attrs[k] = v
+			}
+		default:
+			return malformed("unrecognized field " + strconv.Quote(f))
+		}
+	}
+	return line, nil
+}
@@ -0,0 +1,170 @@
+package skunk
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pendingStatsD returns the total of the named metric waiting to be merged into com.
+func pendingStatsD(s *StatsDServer, com *Component, name string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b := s.pending[com]; b != nil && b.metrics[name] != nil {
+		sum, _ := summarize(b.metrics[name])
+		return sum.Total
+	}
+	return 0
+}
+
+func TestStatsDServerDoesNotBlockOnAgent(t *testing.T) {
+	a := newTestAgent(t)
+	a.Start()
+	defer a.Close()
+	com, err := a.Component("app", "com.example.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStatsDServer(com)
+	go s.ServePacket(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Hold up the runloop. Packets must still be read, and merged with each other while they wait.
+	release := make(chan struct{})
+	a.ops <- func(*Agent) error {
+		<-release
+		return nil
+	}
+
+	const name = "Component/requests[count]"
+	deadline := time.Now().Add(5 * time.Second)
+	sent := 0
+	for pendingStatsD(s, com, name) < 5 && time.Now().Before(deadline) {
+		client.Write([]byte("requests:1|c\nlatency:3|ms"))
+		sent++
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := pendingStatsD(s, com, name); got < 5 {
+		t.Fatalf("pending requests = %v after %d packets; want reading to continue while the agent is busy", got, sent)
+	}
+
+	close(release)
+	// Close waits for everything read to be merged into the component.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := a.Status()
+	if len(st.Unsent.Components) != 1 {
+		t.Fatalf("got %d components; want 1", len(st.Unsent.Components))
+	}
+	metrics := st.Unsent.Components[0].Metrics
+	requests, _ := summarize(metrics[name])
+	latency, _ := summarize(metrics["Component/latency[ms]"])
+	if requests.Total < 5 || requests.Total > float64(sent) || latency.Count != int(requests.Total) {
+		t.Errorf("requests = %+v, latency = %+v; want the same count of each, between 5 and %d", requests, latency, sent)
+	}
+}
+
+func TestStatsDServerGaugeLimit(t *testing.T) {
+	com := &Component{}
+	s := &StatsDServer{MaxGauges: 2}
+
+	s.gauge(com, "a", 1, false)
+	s.gauge(com, "b", 2, false)
+	if got := s.gauge(com, "c", 3, false); got != 3 {
+		t.Errorf("gauge c = %v; want 3", got)
+	}
+	if len(s.gauges) != 2 {
+		t.Errorf("holding %d gauges; want 2", len(s.gauges))
+	}
+
+	// Gauges already held still apply changes, and gauges over the limit apply them to zero.
+	if got := s.gauge(com, "a", 4, true); got != 5 {
+		t.Errorf("gauge a = %v; want 5", got)
+	}
+	if got := s.gauge(com, "c", -1, true); got != -1 {
+		t.Errorf("gauge c = %v; want -1", got)
+	}
+}
+
+// closingConn is a PacketConn that reads packets until it's closed, and then reads two more: one once the server has
+// closed it, and another once the server has merged everything it had pending. It stands in for a conn whose last
+// reads are still being recorded while Close runs.
+type closingConn struct {
+	net.PacketConn
+	s       *StatsDServer
+	packets int
+	reads   int
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (c *closingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.reads++
+	if c.reads <= c.packets-2 {
+		return copy(p, "requests:1|c"), nil, nil
+	}
+
+	<-c.closed
+	if c.reads == c.packets-1 {
+		return copy(p, "requests:1|c"), nil, nil
+	}
+	for !c.drained() {
+		time.Sleep(time.Millisecond)
+	}
+	return copy(p, "requests:1|c"), nil, net.ErrClosed
+}
+
+func (c *closingConn) drained() bool {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return c.s.pending == nil
+}
+
+func (c *closingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestStatsDServerCloseWhileReading(t *testing.T) {
+	a := newTestAgent(t)
+	a.Start()
+	defer a.Close()
+	com, err := a.Component("app", "com.example.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStatsDServer(com)
+	conn := &closingConn{s: s, packets: 5, closed: make(chan struct{})}
+	served := make(chan error, 1)
+	go func() { served <- s.ServePacket(conn) }()
+
+	for !func() bool { s.mu.Lock(); defer s.mu.Unlock(); return s.done != nil }() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("ServePacket() = %v; want nil", err)
+	}
+
+	// Everything read before ServePacket returned is recorded by the time Close returns.
+	requests, _ := summarize(unsentMetrics(t, a)["Component/requests[count]"])
+	if requests.Total != float64(conn.packets) {
+		t.Errorf("requests = %v; want %d", requests.Total, conn.packets)
+	}
+}
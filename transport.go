@@ -0,0 +1,118 @@
+package skunk
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// noMetricsKey is the context key used to mark requests that a Transport must not record metrics for.
+type noMetricsKey struct{}
+
+// WithoutMetrics returns a copy of ctx that tells any Transport handling a request made with it to skip recording
+// metrics for the request. Agents mark their own requests this way, since recording metrics for an agent's requests
+// from within its runloop would deadlock it.
+func WithoutMetrics(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noMetricsKey{}, true)
+}
+
+func skipMetrics(ctx context.Context) bool {
+	skip, _ := ctx.Value(noMetricsKey{}).(bool)
+	return skip
+}
+
+// Transport is an http.RoundTripper that records metrics for outbound requests into a Component. For each host
+// requests are made to, it records:
+//
+//	Component/HTTPClient/<host>/Requests[requests]      -- one per request
+//	Component/HTTPClient/<host>/Errors[errors]          -- one per request that failed without a response
+//	Component/HTTPClient/<host>/ResponseTime[ms]        -- time until response headers were received
+//	Component/HTTPClient/<host>/Status/<N>xx[responses] -- one per response, by status class
+//	Component/HTTPClient/<host>/RequestSize[bytes]      -- request body size, if known in advance
+//	Component/HTTPClient/<host>/ResponseSize[bytes]     -- bytes read from the response body
+//
+// The response size is recorded once the response body is closed or read to its end. The body of a 101 Switching
+// Protocols response is the upgraded connection, which must stay writable, so it's passed through as is and its size
+// isn't recorded.
+//
+// Requests whose context was returned by WithoutMetrics are passed through without recording anything.
+type Transport struct {
+	// Transport is the RoundTripper used to make requests. If nil, http.DefaultTransport is used.
+	Transport http.RoundTripper
+	Component *Component
+}
+
+// NewTransport returns a Transport that records metrics for requests made through rt into c. If rt is nil,
+// http.DefaultTransport is used.
+func NewTransport(c *Component, rt http.RoundTripper) *Transport {
+	return &Transport{Transport: rt, Component: c}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	if skipMetrics(req.Context()) {
+		return rt.RoundTrip(req)
+	}
+
+	start := time.Now()
+	resp, err := rt.RoundTrip(req)
+	elapsed := time.Since(start)
+
+	prefix := "Component/HTTPClient/" + req.URL.Host + "/"
+	metrics := Metrics{
+		prefix + "Requests[requests]": ScalarMetric(1),
+		prefix + "ResponseTime[ms]":   rangeOf(float64(elapsed) / float64(time.Millisecond)),
+	}
+	if req.ContentLength > 0 {
+		metrics[prefix+"RequestSize[bytes]"] = rangeOf(float64(req.ContentLength))
+	}
+
+	if err != nil {
+		metrics[prefix+"Errors[errors]"] = ScalarMetric(1)
+	} else {
+		metrics[prefix+"Status/"+strconv.Itoa(resp.StatusCode/100)+"xx[responses]"] = ScalarMetric(1)
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			resp.Body = &countingBody{ReadCloser: resp.Body, com: t.Component, name: prefix + "ResponseSize[bytes]"}
+		}
+	}
+	t.Component.MergeMetrics(metrics)
+
+	return resp, err
+}
+
+// countingBody wraps a response body to count the bytes read from it. The count is recorded under name in com when the
+// body reaches EOF or is closed, whichever happens first.
+type countingBody struct {
+	io.ReadCloser
+	com  *Component
+	name string
+	n    int64
+	once sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF {
+		b.record()
+	}
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.record()
+	return b.ReadCloser.Close()
+}
+
+func (b *countingBody) record() {
+	b.once.Do(func() {
+		b.com.MergeMetric(b.name, rangeOf(float64(b.n)))
+	})
+}
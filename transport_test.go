@@ -0,0 +1,111 @@
+package skunk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("hello, world"))
+	}))
+	defer srv.Close()
+
+	a, com := newHandlerAgent(t)
+	client := &http.Client{Transport: NewTransport(com, nil)}
+
+	for _, path := range []string{"/", "/missing"} {
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	resp, err := client.Post(srv.URL+"/", "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Requests made without metrics aren't recorded.
+	req, _ := http.NewRequestWithContext(WithoutMetrics(context.Background()), "GET", srv.URL+"/", nil)
+	if resp, err := client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	prefix := "Component/HTTPClient/" + host + "/"
+	metrics := unsentMetrics(t, a)
+	delete(metrics, prefix+"ResponseTime[ms]")
+	checkMetrics(t, metrics, map[string]float64{
+		prefix + "Requests[requests]":    3,
+		prefix + "Status/2xx[responses]": 2,
+		prefix + "Status/4xx[responses]": 1,
+		prefix + "RequestSize[bytes]":    4,
+		prefix + "ResponseSize[bytes]":   float64(len("hello, world") + len("404 page not found\n")),
+	})
+}
+
+func TestTransportError(t *testing.T) {
+	a, com := newHandlerAgent(t)
+	rt := NewTransport(com, roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("connection refused")
+	}))
+	if _, err := rt.RoundTrip(httptest.NewRequest("GET", "http://down.example.com/", nil)); err == nil {
+		t.Fatal("RoundTrip() error = nil")
+	}
+
+	metrics := unsentMetrics(t, a)
+	delete(metrics, "Component/HTTPClient/down.example.com/ResponseTime[ms]")
+	checkMetrics(t, metrics, map[string]float64{
+		"Component/HTTPClient/down.example.com/Requests[requests]": 1,
+		"Component/HTTPClient/down.example.com/Errors[errors]":     1,
+	})
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// upgradedConn is the body of a 101 response: the connection, which can be written to.
+type upgradedConn struct {
+	io.Reader
+	written strings.Builder
+}
+
+func (c *upgradedConn) Write(p []byte) (int, error) { return c.written.Write(p) }
+func (c *upgradedConn) Close() error                { return nil }
+
+func TestTransportSwitchingProtocols(t *testing.T) {
+	_, com := newHandlerAgent(t)
+	conn := &upgradedConn{Reader: strings.NewReader("")}
+	rt := NewTransport(com, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusSwitchingProtocols, Body: conn, Request: req}, nil
+	}))
+
+	req := &http.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "ws.example.com", Path: "/"}}
+	resp, err := rt.RoundTrip(req.WithContext(context.Background()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, ok := resp.Body.(io.Writer)
+	if !ok {
+		t.Fatalf("101 response body %T isn't writable", resp.Body)
+	}
+	w.Write([]byte("ping"))
+	if conn.written.String() != "ping" {
+		t.Errorf("wrote %q to the connection; want ping", conn.written.String())
+	}
+}